@@ -20,19 +20,27 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
-	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	mathrand "math/rand"
 
+	"github.com/emersion/go-msgauth/authres"
 	dkim "github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-sasl"
 	smtp "github.com/emersion/go-smtp"
+	"github.com/mback2k/smtp-dkim-signer/internal/dkimutil"
+	"github.com/mback2k/smtp-dkim-signer/internal/htpasswd"
+	"github.com/mback2k/smtp-dkim-signer/internal/saslutil"
 	"github.com/mback2k/smtp-dkim-signer/internal/smtpproxy"
 	log "github.com/sirupsen/logrus"
 )
@@ -40,17 +48,124 @@ import (
 var (
 	// ErrAuthFailed Error for authentication failure
 	ErrAuthFailed = errors.New("Authentication failed")
+
+	// ErrNoActiveKey Error for a VirtualHost without a currently active DKIM key
+	ErrNoActiveKey = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 5},
+		Message:      "No DKIM key is currently active",
+	}
+
+	// ErrInvalidIdentity Error for a signing identity outside of the VirtualHost domain
+	ErrInvalidIdentity = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender is not allowed to sign for this domain",
+	}
+
+	// ErrFromNotAllowed Error for a sender address the user is not allowed to use
+	ErrFromNotAllowed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address is not allowed for this user",
+	}
+
+	// ErrRelayDenied Error for an unauthenticated sender domain that may not be relayed
+	ErrRelayDenied = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Relaying denied for this sender domain",
+	}
+
+	// ErrCredentialsInvalid Error for credentials rejected once the VirtualHost is known
+	ErrCredentialsInvalid = &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Authentication credentials invalid",
+	}
+
+	// ErrBadSequence Error for a command that needs a transaction started by MAIL FROM
+	ErrBadSequence = &smtp.SMTPError{
+		Code:         503,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "Please send MAIL FROM first",
+	}
+
+	// ErrAuthInTransaction Error for AUTH during a mail transaction
+	ErrAuthInTransaction = &smtp.SMTPError{
+		Code:         503,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "AUTH is not allowed during a mail transaction",
+	}
+
+	// ErrSpoolFailed Error for a message that could not be queued
+	ErrSpoolFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Unable to queue message",
+	}
+
+	// ErrSignFailed Error for a message that could not be signed
+	ErrSignFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Unable to sign message",
+	}
+
+	// ErrVerifyFailed Error for a signed message that did not verify
+	ErrVerifyFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 5},
+		Message:      "Unable to verify signed message",
+	}
 )
 
 type backendVHost struct {
 	Description string
+	Domain      string
 	ByDomain    string
 	ProxyBe     *smtpproxy.Backend
-	DkimOpt     *dkim.SignOptions
+	Signers     []*dkimSigner
+
+	Identity          string
+	SignSubdomain     bool
+	SignatureLifetime time.Duration
+	BodyLength        bool
+	VerifyAfterSign   bool
+
+	RejectDuplicateHeaders bool
+	FromPolicy             *fromPolicy
+	ARCSeal                bool
+	AuthResults            bool
+	AuthzidPolicy          string
+	UpstreamAuth           *upstreamCredentials
+	LocalAuth              bool
+	UseSpool               bool
+}
+
+// upstreamCredentials are used to authenticate against the upstream server
+// instead of the client credentials, which are checked locally.
+type upstreamCredentials struct {
+	Username string
+	Password string
+}
+
+// upstreamClient returns the SASL client for the upstream credentials of
+// bkdvh, which is nil for an LMTP server as it does not authenticate.
+func (bkdvh *backendVHost) upstreamClient() sasl.Client {
+	if bkdvh.UpstreamAuth == nil {
+		return nil
+	}
+	return sasl.NewPlainClient("", bkdvh.UpstreamAuth.Username, bkdvh.UpstreamAuth.Password)
 }
 
 type backend struct {
-	VHosts map[string]*backendVHost
+	VHosts          map[string]*backendVHost
+	Users           *htpasswd.File
+	TrustedNetworks []*net.IPNet
+	Resolution      string
+	UserVHosts      map[string]*backendVHost
+	Spooler         *spooler
 }
 
 type sessionState struct {
@@ -58,9 +173,21 @@ type sessionState struct {
 
 	backend *backend
 	bkdvh   *backendVHost
-
-	from string
-	to   []string
+	conn    *smtp.Conn
+
+	username string
+	auth     upstreamAuthFunc
+	// domain is the domain the VirtualHost was matched for, which
+	// differs from its configured Domain for wildcard VirtualHosts.
+	domain string
+	// trusted is set for clients from TrustedNetworks, relay once they
+	// started a transaction without authentication.
+	trusted bool
+	relay   bool
+
+	from     string
+	mailOpts *smtp.MailOptions
+	to       []string
 }
 
 func (s *sessionState) generateMessageID() string {
@@ -72,15 +199,28 @@ func (s *sessionState) generateMessageID() string {
 	return strings.ToUpper(hex.EncodeToString(idbytes))
 }
 
-func (s *sessionState) writeReceivedHeader(id string, pw *io.PipeWriter) error {
-	bw := bufio.NewWriter(pw)
+// protocol returns the protocol type of the Received header (RFC 3848).
+func (s *sessionState) protocol() string {
+	if !s.relay {
+		return "ESMTPSA"
+	}
+	if s.conn != nil {
+		if _, isTLS := s.conn.TLSConnectionState(); isTLS {
+			return "ESMTPS"
+		}
+	}
+	return "ESMTP"
+}
+
+func (s *sessionState) writeReceivedHeader(id string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
 	if _, err := bw.WriteString("Received: by "); err != nil {
 		return err
 	}
 	if _, err := bw.WriteString(s.bkdvh.ByDomain); err != nil {
 		return err
 	}
-	if _, err := bw.WriteString(" (smtp-dkim-signer) with ESMTPSA id "); err != nil {
+	if _, err := bw.WriteString(" (smtp-dkim-signer) with " + s.protocol() + " id "); err != nil {
 		return err
 	}
 	if _, err := bw.WriteString(id); err != nil {
@@ -99,50 +239,239 @@ func (s *sessionState) writeReceivedHeader(id string, pw *io.PipeWriter) error {
 	return bw.Flush()
 }
 
-func (s *sessionState) signMessage(pw *io.PipeWriter, r io.Reader, id string) {
+func (s *sessionState) signMessage(w io.Writer, r io.Reader, id string, dkimopts []*dkim.SignOptions, results []authres.Result) error {
 	log.WithField("message", id).Tracef("Writing header for message %s", id)
-	if err := s.writeReceivedHeader(id, pw); err != nil {
-		err = fmt.Errorf("unable to write header %s due to: %s", id, err)
-		pw.CloseWithError(err)
-		return
+	if err := s.writeReceivedHeader(id, w); err != nil {
+		return fmt.Errorf("unable to write header %s due to: %s", id, err)
+	}
+	if s.bkdvh.AuthResults {
+		field := "Authentication-Results: " + formatAuthResults(s.bkdvh.ByDomain, results) + "\r\n"
+		if _, err := io.WriteString(w, field); err != nil {
+			return fmt.Errorf("unable to write header %s due to: %s", id, err)
+		}
 	}
 
 	log.WithField("message", id).Tracef("Signing message %s", id)
-	if err := dkim.Sign(pw, r, s.bkdvh.DkimOpt); err != nil {
-		err = fmt.Errorf("unable to sign message %s due to: %s", id, err)
-		pw.CloseWithError(err)
-		return
+	if err := signAll(w, r, dkimopts, s.bkdvh.BodyLength); err != nil {
+		return fmt.Errorf("unable to sign message %s due to: %w", id, err)
 	}
 
 	log.WithField("message", id).Tracef("Signed message %s", id)
-	pw.Close()
+	return nil
+}
+
+func (s *sessionState) sealMessage(msg []byte, id string, cv string, sets []*dkimutil.ARCSet, results []authres.Result, dkimopt *dkim.SignOptions, now time.Time) (*bytes.Buffer, error) {
+	var sealed bytes.Buffer
+	// A chain that already failed or cannot be parsed is not sealed again,
+	// as the instance of a new ARC set would be undefined (RFC 8617 5.1.2).
+	if cv == dkimutil.ChainFail && (sets == nil || sets[len(sets)-1].ChainValue() == dkimutil.ChainFail) {
+		log.WithField("message", id).Warnf("Not sealing message %s with a broken ARC chain", id)
+		sealed.Write(msg)
+		return &sealed, nil
+	}
+
+	m, err := dkimutil.ParseMessage(msg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse message %s due to: %s", id, err)
+	}
+	log.WithField("message", id).Tracef("Sealing message %s with ARC instance %d (cv=%s)", id, len(sets)+1, cv)
+	seal, err := dkimutil.SealARC(m, sets, cv, formatAuthResults(s.bkdvh.ByDomain, results), utilOptions(dkimopt), now)
+	if err != nil {
+		return nil, fmt.Errorf("unable to seal message %s due to: %s", id, err)
+	}
+	sealed.WriteString(seal)
+	sealed.Write(msg)
+	return &sealed, nil
+}
+
+func (s *sessionState) prepareMessage(r io.Reader, id string) (*bytes.Buffer, error) {
+	now := time.Now()
+	dkimopts := activeOptions(s.bkdvh.Signers, now)
+	if len(dkimopts) == 0 {
+		log.WithField("message", id).Errorf("Handling message %s failed: no DKIM key is active", id)
+		return nil, ErrNoActiveKey
+	}
+
+	domain := dkimopts[0].Domain
+	if s.bkdvh.SignSubdomain && s.domain != "" {
+		domain = s.domain
+	}
+	var identity string
+	if s.bkdvh.Identity != "" {
+		var err error
+		identity, err = expandIdentity(s.bkdvh.Identity, domain, s.username)
+		if err != nil {
+			log.WithField("message", id).WithError(err).Errorf("Handling message %s failed: %s", id, err)
+			return nil, ErrInvalidIdentity
+		}
+	}
+	dkimopts = messageOptions(dkimopts, domain, identity, s.bkdvh.SignatureLifetime, now)
+
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.WithField("message", id).WithError(err).Errorf("Handling message %s failed: %s", id, err)
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return nil, smtpErr
+		}
+		return nil, ErrSignFailed
+	}
+
+	var m *dkimutil.Message
+	if s.bkdvh.RejectDuplicateHeaders || s.bkdvh.FromPolicy != nil || s.bkdvh.ARCSeal || s.bkdvh.AuthResults {
+		m, err = dkimutil.ParseMessage(msg)
+		if err != nil {
+			log.WithField("message", id).WithError(err).Errorf("Rejecting message %s: %s", id, err)
+			return nil, errInvalidHeader("Message header is malformed")
+		}
+	}
+	if s.bkdvh.RejectDuplicateHeaders {
+		if err := checkSingletonHeaders(m.Header); err != nil {
+			log.WithField("message", id).WithError(err).Errorf("Rejecting message %s: %s", id, err)
+			return nil, err
+		}
+	}
+	if s.bkdvh.FromPolicy != nil {
+		if err := s.bkdvh.FromPolicy.checkFromHeader(m.Header, s.username, s.domain); err != nil {
+			log.WithField("message", id).WithError(err).Errorf("Rejecting message %s: %s", id, err)
+			if errors.Is(err, ErrFromNotAllowed) {
+				return nil, ErrFromNotAllowed
+			}
+			return nil, err
+		}
+	}
+
+	var results []authres.Result
+	if s.bkdvh.AuthResults || s.bkdvh.ARCSeal {
+		user := s.username
+		if s.relay {
+			user = ""
+		}
+		results = submissionResults(msg, user)
+	}
+
+	var arcChain string
+	var arcSets []*dkimutil.ARCSet
+	if s.bkdvh.ARCSeal {
+		// The chain is validated before our own header fields are added.
+		arcChain, arcSets, err = dkimutil.ValidateARCChain(m, lookupTXT)
+		if err != nil {
+			log.WithField("message", id).WithError(err).Warnf("ARC chain of message %s failed: %s", id, err)
+		}
+		results = append(results, &authres.GenericResult{Method: "arc", Value: authres.ResultValue(arcChain)})
+	}
+
+	if s.bkdvh.AuthResults || s.bkdvh.ARCSeal {
+		// Only we may add results of our authserv-id.
+		if n := stripAuthResults(m, s.bkdvh.ByDomain); n > 0 {
+			log.WithField("message", id).Warnf("Removed %d Authentication-Results header field(s) of %s from message %s", n, s.bkdvh.ByDomain, id)
+			msg = append(m.Header.Bytes(), m.Body...)
+		}
+	}
+
+	signed := new(bytes.Buffer)
+	if err := s.signMessage(signed, bytes.NewReader(msg), id, dkimopts, results); err != nil {
+		log.WithField("message", id).WithError(err).Errorf("Handling message %s failed: %s", id, err)
+		return nil, ErrSignFailed
+	}
+
+	if s.bkdvh.ARCSeal {
+		if arcopt := arcOptions(dkimopts); arcopt == nil {
+			log.WithField("message", id).Warnf("Not sealing message %s without an active RSA key", id)
+		} else {
+			sealed, err := s.sealMessage(signed.Bytes(), id, arcChain, arcSets, results, arcopt, now)
+			if err != nil {
+				log.WithField("message", id).WithError(err).Errorf("Handling message %s failed: %s", id, err)
+				return nil, ErrSignFailed
+			}
+			signed = sealed
+		}
+	}
+
+	if s.bkdvh.VerifyAfterSign {
+		log.WithField("message", id).Tracef("Verifying message %s", id)
+		if err := verifyAll(signed.Bytes(), dkimopts); err != nil {
+			log.WithField("message", id).WithError(err).Errorf("Verifying message %s failed: %s", id, err)
+			return nil, ErrVerifyFailed
+		}
+	}
+	return signed, nil
 }
 
 func (s *sessionState) Reset() {
 	s.from = ""
+	s.mailOpts = nil
 	s.to = nil
-	s.Session.Reset()
+	if s.Session != nil {
+		s.Session.Reset()
+	}
 }
 
 func (s *sessionState) Mail(from string, opts *smtp.MailOptions) error {
-	if s.Session == nil {
-		return smtp.ErrAuthRequired
+	if s.auth == nil {
+		if !s.trusted {
+			return smtp.ErrAuthRequired
+		}
+		s.auth = relayAuth
+		s.relay = true
+	}
+
+	switch {
+	case s.relay || s.backend.Resolution == resolveMailFrom:
+		bkdvh, domain := s.backend.lookupVHost(addressDomain(from))
+		if bkdvh == nil {
+			log.Infof("Rejecting MAIL FROM %s: no VirtualHost for its domain", from)
+			return ErrRelayDenied
+		}
+		if s.relay {
+			s.username = from
+		}
+		if err := s.useVHost(bkdvh); err != nil {
+			return err
+		}
+		s.domain = domain
+	case s.deferred():
+		// The VirtualHost is selected by the From header field, so
+		// the transaction is replayed upstream in Data().
+		s.from = from
+		s.mailOpts = opts
+		return nil
+	}
+	return s.mail(from, opts)
+}
+
+// deferred reports whether the transaction is only sent upstream in Data().
+func (s *sessionState) deferred() bool {
+	return s.backend.Resolution == resolveHeader && !s.relay
+}
+
+func (s *sessionState) mail(from string, opts *smtp.MailOptions) error {
+	// The null reverse-path of delivery status notifications is not checked,
+	// their From header field still is.
+	if s.bkdvh.FromPolicy != nil && from != "" && !s.bkdvh.FromPolicy.allows(s.username, s.domain, from) {
+		log.Infof("Rejecting MAIL FROM %s for %s: not allowed by FromPolicy", from, s.username)
+		return ErrFromNotAllowed
 	}
 	err := s.Session.Mail(from, opts)
 	if err != nil {
 		return err
 	}
 	s.from = from
+	s.mailOpts = opts
 	return nil
 }
 
 func (s *sessionState) Rcpt(to string) error {
-	if s.Session == nil {
+	if s.auth == nil {
 		return smtp.ErrAuthRequired
 	}
-	err := s.Session.Rcpt(to)
-	if err != nil {
-		return err
+	if !s.deferred() {
+		if s.Session == nil {
+			return ErrBadSequence
+		}
+		if err := s.Session.Rcpt(to); err != nil {
+			return err
+		}
 	}
 	if s.to != nil {
 		s.to = append(s.to, to)
@@ -153,17 +482,35 @@ func (s *sessionState) Rcpt(to string) error {
 }
 
 func (s *sessionState) Data(r io.Reader) error {
-	if s.Session == nil {
+	if s.auth == nil {
 		return smtp.ErrAuthRequired
 	}
 
 	id := s.generateMessageID()
 	log.WithField("message", id).Infof("Handling message %s from %s to %s", id, s.from, s.to)
 
-	pr, pw := io.Pipe()
-	go s.signMessage(pw, r, id)
+	if s.deferred() {
+		msg, err := ioutil.ReadAll(r)
+		if err != nil {
+			s.Reset()
+			return err
+		}
+		if err := s.replayTransaction(msg, id); err != nil {
+			s.Reset()
+			return err
+		}
+		r = bytes.NewReader(msg)
+	} else if s.Session == nil {
+		return ErrBadSequence
+	}
+
+	signed, err := s.prepareMessage(r, id)
+	if err != nil {
+		s.Reset()
+		return err
+	}
 
-	err := s.Session.Data(pr)
+	err = s.Session.Data(signed)
 	if err != nil {
 		log.WithField("message", id).WithError(err).Errorf("Handling message %s failed: %s", id, err)
 	}
@@ -172,6 +519,37 @@ func (s *sessionState) Data(r io.Reader) error {
 	return err
 }
 
+// replayTransaction selects the VirtualHost by the From header field of msg
+// and sends the recorded MAIL and RCPT commands to its upstream server.
+func (s *sessionState) replayTransaction(msg []byte, id string) error {
+	addr, err := headerFromAddress(msg)
+	if err != nil {
+		log.WithField("message", id).WithError(err).Errorf("Rejecting message %s: %s", id, err)
+		return errInvalidHeader("Message has no valid From header field")
+	}
+	bkdvh, domain := s.backend.lookupVHost(addressDomain(addr))
+	if bkdvh == nil {
+		log.WithField("message", id).Infof("Rejecting message %s: no VirtualHost for From %s", id, addr)
+		return ErrRelayDenied
+	}
+	if err := s.useVHost(bkdvh); err != nil {
+		return err
+	}
+	s.domain = domain
+
+	to := s.to
+	if err := s.mail(s.from, s.mailOpts); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := s.Session.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	s.to = to
+	return nil
+}
+
 func (s *sessionState) Logout() error {
 	if s.Session == nil {
 		return smtp.ErrAuthRequired
@@ -183,52 +561,336 @@ func (s *sessionState) Logout() error {
 func (bkd *backend) NewSession(state *smtp.Conn) (smtp.Session, error) {
 	return &sessionState{
 		backend: bkd,
-		// Session and bkdvh are filled in on successful AuthPlain().
+		conn:    state,
+		trusted: bkd.isTrusted(state.Conn().RemoteAddr()),
+		// auth is filled in on successful AuthPlain() or, for trusted
+		// clients, on Mail(). Session and bkdvh are filled in as soon
+		// as the VirtualHost is known.
 	}, nil
 }
 
+func (bkd *backend) isTrusted(addr net.Addr) bool {
+	tcpaddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range bkd.TrustedNetworks {
+		if network.Contains(tcpaddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// saslAuthenticator is implemented by upstream sessions that support
+// authentication with an arbitrary SASL client.
+type saslAuthenticator interface {
+	Auth(auth sasl.Client) error
+}
+
+// upstreamAuthFunc checks whether the client may use the VirtualHost and
+// returns the SASL client to authenticate against its upstream server.
+type upstreamAuthFunc func(bkdvh *backendVHost) (sasl.Client, error)
+
+func relayAuth(bkdvh *backendVHost) (sasl.Client, error) {
+	if !bkdvh.LocalAuth {
+		log.Infof("Relay denied: %s has no upstream credentials", bkdvh.Description)
+		return nil, ErrRelayDenied
+	}
+	return bkdvh.upstreamClient(), nil
+}
+
 func (s *sessionState) AuthPlain(username, password string) error {
-	splits := strings.Split(username, "@")
-	if len(splits) < 1 {
-		return ErrAuthFailed
+	return s.authenticate("", username, password)
+}
+
+// authenticate handles AUTH PLAIN and LOGIN, acting as identity if set.
+func (s *sessionState) authenticate(identity, username, password string) error {
+	user := username
+	if identity != "" {
+		user = identity
 	}
-	domain := splits[len(splits)-1]
-	if len(domain) < 1 {
-		return ErrAuthFailed
+	return s.login(username, user, func(bkdvh *backendVHost) (sasl.Client, error) {
+		if !authorizes(bkdvh.AuthzidPolicy, username, identity) {
+			log.Infof("Auth failed: %q may not act as %q", username, identity)
+			return nil, ErrAuthFailed
+		}
+		if bkdvh.LocalAuth {
+			if s.backend.Users == nil {
+				log.Infof("Auth failed: user %q: no UsersFile configured", username)
+				return nil, ErrAuthFailed
+			}
+			if err := s.backend.Users.Authenticate(username, password); err != nil {
+				log.Infof("Auth failed: user %q: %s", username, err)
+				return nil, ErrAuthFailed
+			}
+			return bkdvh.upstreamClient(), nil
+		}
+		return sasl.NewPlainClient(identity, username, password), nil
+	})
+}
+
+// authenticateXOAuth2 relays the bearer token of AUTH XOAUTH2.
+func (s *sessionState) authenticateXOAuth2(username, token string) error {
+	return s.login(username, username, func(bkdvh *backendVHost) (sasl.Client, error) {
+		if bkdvh.LocalAuth {
+			log.Infof("Auth failed: bearer token of %q cannot be checked locally", username)
+			return nil, ErrAuthFailed
+		}
+		return saslutil.NewXOAuth2Client(username, token), nil
+	})
+}
+
+// authenticateOAuthBearer relays the bearer token of AUTH OAUTHBEARER,
+// whose authorization identity is the username.
+func (s *sessionState) authenticateOAuthBearer(opts sasl.OAuthBearerOptions) error {
+	return s.login(opts.Username, opts.Username, func(bkdvh *backendVHost) (sasl.Client, error) {
+		if bkdvh.LocalAuth {
+			log.Infof("Auth failed: bearer token of %q cannot be checked locally", opts.Username)
+			return nil, ErrAuthFailed
+		}
+		upstream := &sasl.OAuthBearerOptions{Username: opts.Username, Token: opts.Token}
+		// The session may end up on a failover server, the host and
+		// port are only informational for the upstream server though.
+		if host, port, err := net.SplitHostPort(bkdvh.ProxyBe.Addrs[0]); err == nil {
+			upstream.Host = host
+			upstream.Port, _ = strconv.Atoi(port)
+		}
+		return sasl.NewOAuthBearerClient(upstream), nil
+	})
+}
+
+// login records how the client authenticates upstream as user. If the
+// VirtualHost is selected by the login, it is authenticated right away,
+// otherwise once the VirtualHost is known in Mail() or Data().
+func (s *sessionState) login(login, user string, auth upstreamAuthFunc) error {
+	// A trusted client may authenticate after relaying, but the
+	// transaction must not continue with another upstream session.
+	if s.from != "" {
+		return ErrAuthInTransaction
 	}
-	bkdvh, found := s.backend.VHosts[domain]
-	if !found {
-		log.Infof("Auth failed: domain %q not found", domain)
+	s.Reset()
+	if s.Session != nil {
+		s.Session.Logout()
+		s.Session = nil
+	}
+	s.bkdvh = nil
+	s.domain = ""
+	s.username = user
+	s.auth = auth
+	s.relay = false
+
+	if !s.backend.resolvesAtLogin() {
+		// The VirtualHost selected by the sender signs with its keys,
+		// so it must be granted to the login.
+		s.auth = func(bkdvh *backendVHost) (sasl.Client, error) {
+			client, err := auth(bkdvh)
+			if err != nil {
+				return nil, err
+			}
+			if !s.backend.grantsVHost(login, bkdvh) {
+				log.Infof("Auth failed: user %q may not use %s", login, bkdvh.Description)
+				return nil, ErrCredentialsInvalid
+			}
+			return client, nil
+		}
+		return nil
+	}
+	bkdvh, domain := s.backend.loginVHost(login)
+	if bkdvh == nil {
+		log.Infof("Auth failed: no VirtualHost for login %q", login)
+		s.auth = nil
 		return ErrAuthFailed
 	}
-	s.bkdvh = bkdvh
+	if err := s.useVHost(bkdvh); err != nil {
+		s.auth = nil
+		return err
+	}
+	s.domain = domain
+	return nil
+}
 
-	session, err := bkdvh.ProxyBe.NewSession(nil)
+// useVHost opens a session to the upstream server of bkdvh unless there
+// already is one, replacing a session for another VirtualHost.
+func (s *sessionState) useVHost(bkdvh *backendVHost) error {
+	if s.Session != nil && s.bkdvh == bkdvh {
+		return nil
+	}
+	auth, err := s.auth(bkdvh)
+	if err == ErrAuthFailed && !s.backend.resolvesAtLogin() {
+		// Credentials of deferred logins are only checked during the
+		// transaction, where the AUTH failure response does not apply.
+		return ErrCredentialsInvalid
+	}
 	if err != nil {
 		return err
 	}
-	if err := session.AuthPlain(username, password); err != nil {
-		return err
+	if s.Session != nil {
+		s.Session.Logout()
+		s.Session = nil
 	}
+	s.bkdvh = bkdvh
 
+	if bkdvh.UseSpool {
+		s.Session = &spoolSession{spooler: s.backend.Spooler, vhost: bkdvh.Domain}
+		return nil
+	}
+	session, err := openUpstream(bkdvh, auth)
+	if err != nil {
+		return err
+	}
 	s.Session = session
 	return nil
 }
 
+// openUpstream opens a session to the upstream server of bkdvh, which is
+// authenticated using auth.
+func openUpstream(bkdvh *backendVHost, auth sasl.Client) (smtp.Session, error) {
+	if bkdvh.LocalAuth && bkdvh.ProxyBe.MaxIdlePerHost > 0 {
+		// All clients share the upstream credentials of the VirtualHost,
+		// if any, so their connections can be reused.
+		return bkdvh.ProxyBe.NewPooledSession(auth)
+	}
+
+	session, err := bkdvh.ProxyBe.NewSession(nil)
+	if err != nil {
+		return nil, err
+	}
+	if bkdvh.ProxyBe.LMTP {
+		// LMTP servers do not authenticate, the client was already
+		// authenticated locally.
+		return session, nil
+	}
+	if err := session.(saslAuthenticator).Auth(auth); err != nil {
+		session.Logout()
+		return nil, err
+	}
+	return session, nil
+}
+
+// makeSigningVHost returns the VirtualHost for cfgvh with only the state
+// needed to sign its messages, without any upstream server.
+func makeSigningVHost(cfg *config, cfgvh *configVHost) (*backendVHost, error) {
+	signers, err := makeOptions(cfg, cfgvh)
+	if err != nil {
+		return nil, err
+	}
+	vhostbe := &backendVHost{Domain: strings.ToLower(cfgvh.Domain), ByDomain: cfg.Domain, Signers: signers}
+	vhostbe.Identity = cfgvh.Identity
+	vhostbe.SignSubdomain = cfgvh.SignSubdomain
+	vhostbe.SignatureLifetime = cfgvh.SignatureLifetime
+	vhostbe.BodyLength = cfgvh.BodyLength
+	vhostbe.VerifyAfterSign = cfgvh.VerifyAfterSign
+	vhostbe.RejectDuplicateHeaders = cfgvh.RejectDuplicateHeaders
+	vhostbe.ARCSeal = cfgvh.ARCSeal
+	vhostbe.AuthResults = cfgvh.AuthResults
+	vhostbe.AuthzidPolicy, err = makeAuthzidPolicy(cfgvh.AuthzidPolicy)
+	if err != nil {
+		return nil, err
+	}
+	vhostbe.FromPolicy, err = makeFromPolicy(cfgvh)
+	if err != nil {
+		return nil, err
+	}
+	return vhostbe, nil
+}
+
 func makeBackend(cfg *config) (*backend, error) {
 	var be backend
 	be.VHosts = make(map[string]*backendVHost)
+	for _, cidr := range cfg.TrustedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse TrustedNetworks due to: %s", err)
+		}
+		be.TrustedNetworks = append(be.TrustedNetworks, network)
+	}
+	if cfg.UsersFile != "" {
+		users, err := htpasswd.NewFile(cfg.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load UsersFile due to: %s", err)
+		}
+		be.Users = users
+	}
+	spooler, err := makeSpooler(cfg, &be)
+	if err != nil {
+		return nil, err
+	}
+	be.Spooler = spooler
 	for idx, cfgvh := range cfg.VirtualHosts {
-		dkimopt, err := makeOptions(cfg, cfgvh)
+		vhostbe, err := makeSigningVHost(cfg, cfgvh)
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup VirtualHost #%d due to: %s", idx, err)
+		}
+		now := time.Now()
+		for _, signer := range vhostbe.Signers {
+			if !signer.NotAfter.IsZero() && !now.Before(signer.NotAfter) {
+				log.Warnf("VirtualHost #%d: selector %s is retired since %s", idx, signer.Options.Selector, signer.NotAfter)
+			}
+		}
+		if len(activeOptions(vhostbe.Signers, now)) == 0 {
+			log.Warnf("VirtualHost #%d: no DKIM key is currently active", idx)
+		}
+
+		if cfgvh.UpstreamUsername != "" {
+			password, err := readPassphrase(cfgvh.UpstreamPassword, cfgvh.UpstreamPasswordPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to setup VirtualHost #%d due to: %s", idx, err)
+			}
+			vhostbe.UpstreamAuth = &upstreamCredentials{Username: cfgvh.UpstreamUsername, Password: string(password)}
+		}
+		if len(cfgvh.AllowedFrom) > 0 && (vhostbe.FromPolicy == nil || vhostbe.FromPolicy.Mode != fromPolicyAllowList) {
+			log.Warnf("VirtualHost #%d: AllowedFrom is ignored without FromPolicy %s", idx, fromPolicyAllowList)
+		}
+		vhostbe.Description = fmt.Sprintf("VirtualHost #%d: %s via %s", idx, cfgvh.Domain, strings.Join(cfgvh.Upstream, ", "))
+		vhostbe.ProxyBe, err = makeUpstream(cfgvh)
 		if err != nil {
 			return nil, fmt.Errorf("unable to setup VirtualHost #%d due to: %s", idx, err)
 		}
 
-		vhostbe := &backendVHost{ByDomain: cfg.Domain, DkimOpt: dkimopt}
-		vhostbe.Description = fmt.Sprintf("VirtualHost #%d: %s via %s", idx, cfgvh.Domain, cfgvh.Upstream)
-		vhostbe.ProxyBe = smtpproxy.NewTLS(cfgvh.Upstream, &tls.Config{})
+		if vhostbe.ProxyBe.LMTP && vhostbe.UpstreamAuth != nil {
+			log.Warnf("VirtualHost #%d: UpstreamUsername is ignored with UpstreamSecurity %s", idx, upstreamSecurityLMTP)
+			vhostbe.UpstreamAuth = nil
+		}
+		// Clients cannot be authenticated against an LMTP server, so
+		// they are authenticated locally like with upstream credentials.
+		vhostbe.LocalAuth = vhostbe.UpstreamAuth != nil || vhostbe.ProxyBe.LMTP
+		if vhostbe.LocalAuth && be.Users == nil {
+			log.Warnf("VirtualHost #%d: without UsersFile only TrustedNetworks can use this VirtualHost", idx)
+		}
+		if cfgvh.UpstreamMaxIdle > 0 && !vhostbe.LocalAuth {
+			log.Warnf("VirtualHost #%d: UpstreamMaxIdle is ignored without UpstreamUsername or UpstreamSecurity %s", idx, upstreamSecurityLMTP)
+		}
+		if cfgvh.SignSubdomain && !strings.HasPrefix(cfgvh.Domain, "*.") {
+			log.Warnf("VirtualHost #%d: SignSubdomain is ignored without a wildcard Domain", idx)
+		}
+		if cfgvh.UseSpool {
+			if !vhostbe.LocalAuth {
+				return nil, fmt.Errorf("unable to setup VirtualHost #%d due to: UseSpool requires UpstreamUsername or UpstreamSecurity %s", idx, upstreamSecurityLMTP)
+			}
+			if be.Spooler == nil {
+				return nil, fmt.Errorf("unable to setup VirtualHost #%d due to: UseSpool requires Spool.Path", idx)
+			}
+			vhostbe.UseSpool = true
+		}
+		be.VHosts[vhostbe.Domain] = vhostbe
+	}
 
-		be.VHosts[cfgvh.Domain] = vhostbe
+	resolution, err := makeResolution(cfg.VHostResolution)
+	if err != nil {
+		return nil, err
+	}
+	be.Resolution = resolution
+	be.UserVHosts = make(map[string]*backendVHost)
+	for idx, mapping := range cfg.UserVirtualHosts {
+		bkdvh, found := be.VHosts[strings.ToLower(mapping.VirtualHost)]
+		if mapping.User == "" || !found {
+			return nil, fmt.Errorf("unable to setup UserVirtualHosts #%d due to: unknown VirtualHost %q", idx, mapping.VirtualHost)
+		}
+		be.UserVHosts[mapping.User] = bkdvh
+	}
+	if len(be.UserVHosts) > 0 && be.Resolution != resolveMapping {
+		log.Warnf("UserVirtualHosts is ignored without VHostResolution %s", resolveMapping)
 	}
 	return &be, nil
 }
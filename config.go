@@ -21,6 +21,7 @@ package main
 import (
 	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
@@ -32,6 +33,10 @@ var defaultHeaderKeys = []string{
 	"List-Post", "List-Owner", "List-Archive",
 }
 
+var defaultOversignHeaders = []string{
+	"From", "To", "Subject", "Date", "Reply-To",
+}
+
 type configAcmeLe struct {
 	Agreed        bool
 	Contact       string
@@ -45,14 +50,78 @@ type configTLS struct {
 	KeyPath  string
 }
 
+type configSigner struct {
+	Selector              string
+	PrivKeyPath           string
+	PrivKeyPassphrase     string
+	PrivKeyPassphrasePath string
+	NotBefore             time.Time
+	NotAfter              time.Time
+}
+
 type configVHost struct {
-	Domain      string
-	Upstream    string
-	Selector    string
-	PrivKeyPath string
-	HeaderCan   string
-	BodyCan     string
-	HeaderKeys  []string
+	Domain                string
+	Upstream              []string
+	Selector              string
+	PrivKeyPath           string
+	PrivKeyPassphrase     string
+	PrivKeyPassphrasePath string
+	Signers               []*configSigner
+	HeaderCan             string
+	BodyCan               string
+	HeaderKeys            []string
+	OversignHeaders       []string
+	Hash                  string
+	Identity              string
+	SignSubdomain         bool
+	SignatureLifetime     time.Duration
+	BodyLength            bool
+	VerifyAfterSign       bool
+
+	RejectDuplicateHeaders bool
+	FromPolicy             string
+	AllowedFrom            []*configAllowedFrom
+	ARCSeal                bool
+	AuthResults            bool
+	AuthzidPolicy          string
+	UpstreamUsername       string
+	UpstreamPassword       string
+	UpstreamPasswordPath   string
+	UpstreamSecurity       string
+	UpstreamBalance        string
+	UpstreamWeights        []int
+	UpstreamMaxConns       int
+	UpstreamMaxIdle        int
+	UpstreamIdleTimeout    time.Duration
+	UpstreamDialTimeout    time.Duration
+	UseSpool               bool
+	UpstreamTLS            *configUpstreamTLS
+	LocalName              string
+}
+
+type configUpstreamTLS struct {
+	CAPath     string
+	ServerName string
+	MinVersion string
+	CertPath   string
+	KeyPath    string
+}
+
+type configUserVHost struct {
+	User        string
+	VirtualHost string
+}
+
+type configAllowedFrom struct {
+	User      string
+	Addresses []string
+}
+
+type configSpool struct {
+	Path             string
+	Lifetime         time.Duration
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
 }
 
 type configLogging struct {
@@ -75,9 +144,15 @@ type config struct {
 	MaxMessageBytes   int
 	MaxRecipients     int
 	AllowInsecureAuth bool
+	UsersFile         string
+	TrustedNetworks   []string
+	VHostResolution   string
+	UserVirtualHosts  []*configUserVHost
 	VirtualHosts      []*configVHost
 	HeaderKeys        []string
+	OversignHeaders   []string
 
+	Spool   *configSpool
 	Logging *configLogging
 	Rollbar *configRollbar
 }
@@ -92,6 +167,7 @@ func loadConfig() (*config, error) {
 	vpr.SetDefault("MaxRecipients", 50)
 	vpr.SetDefault("AllowInsecureAuth", false)
 	vpr.SetDefault("HeaderKeys", defaultHeaderKeys)
+	vpr.SetDefault("OversignHeaders", defaultOversignHeaders)
 	vpr.SetConfigName("smtp-dkim-signer")
 	vpr.AddConfigPath("/etc/smtp-dkim-signer/")
 	vpr.AddConfigPath("$HOME/.smtp-dkim-signer")
@@ -102,7 +178,13 @@ func loadConfig() (*config, error) {
 	}
 
 	var cfg config
-	err = vpr.UnmarshalExact(&cfg)
+	err = vpr.UnmarshalExact(&cfg, viper.DecodeHook(
+		mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToTimeHookFunc(time.RFC3339),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	))
 	if err != nil {
 		return nil, err
 	}
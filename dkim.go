@@ -19,73 +19,528 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"strings"
+	"time"
 
 	dkim "github.com/emersion/go-msgauth/dkim"
+	"github.com/mback2k/smtp-dkim-signer/internal/dkimutil"
+	"github.com/mback2k/smtp-dkim-signer/internal/keyutil"
+	log "github.com/sirupsen/logrus"
 )
 
-func loadPrivKey(privkeypath string) (*rsa.PrivateKey, error) {
-	var block *pem.Block
+func readPrivKey(privkeypath string) ([]byte, error) {
 	privkey := strings.TrimSpace(privkeypath)
 	if strings.HasPrefix(privkey, "-----") &&
 		strings.HasSuffix(privkey, "-----") {
-		block, _ = pem.Decode([]byte(privkey))
-	} else {
-		splits := strings.Split(privkeypath, "\n")
-		filepath := strings.TrimSpace(splits[0])
-		bytes, err := ioutil.ReadFile(filepath)
+		return []byte(privkey), nil
+	}
+	if seed, err := base64.StdEncoding.DecodeString(privkey); err == nil &&
+		len(seed) == ed25519.SeedSize {
+		return []byte(privkey), nil
+	}
+	splits := strings.Split(privkeypath, "\n")
+	filepath := strings.TrimSpace(splits[0])
+	return ioutil.ReadFile(filepath)
+}
+
+func parseEd25519Seed(data []byte) (crypto.Signer, error) {
+	if len(data) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(data), nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("no PEM block found and not a raw Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func readPassphrase(passphrase, passphrasepath string) ([]byte, error) {
+	if passphrasepath == "" {
+		return []byte(passphrase), nil
+	}
+	bytes, err := ioutil.ReadFile(passphrasepath)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(string(bytes), "\r\n")), nil
+}
+
+func decryptPrivKey(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("private key is encrypted, but no passphrase is configured")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		der, err := keyutil.DecryptPKCS8(block.Bytes, passphrase)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("unable to decrypt private key: %s", err)
 		}
-		block, _ = pem.Decode(bytes)
+		return der, nil
+	}
+	//lint:ignore SA1019 legacy encrypted PEM blocks are still in use
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if err == x509.IncorrectPasswordError {
+		return nil, fmt.Errorf("unable to decrypt private key: %s", keyutil.ErrIncorrectPassphrase)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to decrypt private key: %s", err)
 	}
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	return der, nil
+}
+
+func loadPrivKey(privkeypath string, passphrase []byte) (crypto.Signer, error) {
+	data, err := readPrivKey(privkeypath)
 	if err != nil {
 		return nil, err
 	}
-	if err := key.Validate(); err != nil {
-		return nil, err
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return parseEd25519Seed(data)
+	}
+
+	der := block.Bytes
+	//lint:ignore SA1019 legacy encrypted PEM blocks are still in use
+	encrypted := block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block)
+	if encrypted {
+		der, err = decryptPrivKey(block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	default:
+		err = fmt.Errorf("unsupported PEM block type %q, expected RSA PRIVATE KEY, PRIVATE KEY or ENCRYPTED PRIVATE KEY", block.Type)
+	}
+	if err != nil && encrypted {
+		return nil, fmt.Errorf("unable to parse decrypted private key, the passphrase is probably incorrect: %s", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", block.Type, err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+func keyAlgo(signer crypto.Signer) (string, error) {
+	switch pubkey := signer.Public().(type) {
+	case *rsa.PublicKey:
+		// RFC 8301 section 3.2: verifiers MUST NOT consider signatures
+		// using RSA keys of less than 1024 bits as valid signatures.
+		if pubkey.Size()*8 < 1024 {
+			return "", fmt.Errorf("RSA key is too short: want at least 1024 bits, has %d bits", pubkey.Size()*8)
+		}
+		return "rsa", nil
+	case ed25519.PublicKey:
+		if len(pubkey) != ed25519.PublicKeySize {
+			return "", fmt.Errorf("invalid Ed25519 public key size: %d bytes", len(pubkey))
+		}
+		return "ed25519", nil
+	default:
+		return "", fmt.Errorf("unsupported key algorithm %T", pubkey)
+	}
+}
+
+func signerList(cfgvh *configVHost) []*configSigner {
+	signers := cfgvh.Signers
+	if cfgvh.Selector != "" || cfgvh.PrivKeyPath != "" {
+		legacy := &configSigner{
+			Selector:              cfgvh.Selector,
+			PrivKeyPath:           cfgvh.PrivKeyPath,
+			PrivKeyPassphrase:     cfgvh.PrivKeyPassphrase,
+			PrivKeyPassphrasePath: cfgvh.PrivKeyPassphrasePath,
+		}
+		signers = append([]*configSigner{legacy}, signers...)
+	}
+	return signers
+}
+
+func dkimRecord(pubkey crypto.PublicKey) (string, error) {
+	var algo string
+	var der []byte
+	switch pubkey := pubkey.(type) {
+	case *rsa.PublicKey:
+		bytes, err := x509.MarshalPKIXPublicKey(pubkey)
+		if err != nil {
+			return "", err
+		}
+		algo, der = "rsa", bytes
+	case ed25519.PublicKey:
+		algo, der = "ed25519", pubkey
+	default:
+		return "", fmt.Errorf("unsupported key algorithm %T", pubkey)
+	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", algo, base64.StdEncoding.EncodeToString(der)), nil
+}
+
+type dkimSigner struct {
+	Options   *dkim.SignOptions
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+func (ds *dkimSigner) activeAt(t time.Time) bool {
+	if !ds.NotBefore.IsZero() && t.Before(ds.NotBefore) {
+		return false
+	}
+	if !ds.NotAfter.IsZero() && !t.Before(ds.NotAfter) {
+		return false
+	}
+	return true
+}
+
+func activeOptions(signers []*dkimSigner, t time.Time) []*dkim.SignOptions {
+	var dkimopts []*dkim.SignOptions
+	for _, signer := range signers {
+		if signer.activeAt(t) {
+			dkimopts = append(dkimopts, signer.Options)
+		}
+	}
+	return dkimopts
+}
+
+// arcOptions returns the first of dkimopts with an RSA key, as ARC only
+// defines rsa-sha256 (RFC 8617 section 4.1.3), or nil if there is none.
+func arcOptions(dkimopts []*dkim.SignOptions) *dkim.SignOptions {
+	for _, dkimopt := range dkimopts {
+		if _, ok := dkimopt.Signer.Public().(*rsa.PublicKey); ok {
+			return dkimopt
+		}
+	}
+	return nil
+}
+
+// parseHash returns the hash algorithm for Hash, which can only be sha256.
+func parseHash(name string) (crypto.Hash, error) {
+	switch strings.ToLower(name) {
+	case "", "sha256":
+		return crypto.SHA256, nil
+	case "sha1":
+		// RFC 8301 section 3.1: rsa-sha1 MUST NOT be used for signing.
+		return 0, fmt.Errorf("hash algorithm sha1 is too weak (RFC 8301), only sha256 is supported")
+	default:
+		return 0, fmt.Errorf("unsupported hash algorithm %q, only sha256 is supported", name)
+	}
+}
+
+func expandIdentity(template, domain, user string) (string, error) {
+	localpart := user
+	if idx := strings.LastIndex(user, "@"); idx >= 0 {
+		localpart = user[:idx]
+	}
+	identity := strings.NewReplacer(
+		"{user}", user,
+		"{localpart}", localpart,
+		"{domain}", domain,
+	).Replace(template)
+
+	if strings.ContainsAny(identity, "; \t\r\n=") {
+		return "", fmt.Errorf("identity %q contains invalid characters", identity)
+	}
+	idx := strings.LastIndex(identity, "@")
+	if idx < 0 {
+		return "", fmt.Errorf("identity %q is not an address", identity)
+	}
+	idomain := strings.ToLower(identity[idx+1:])
+	domain = strings.ToLower(domain)
+	if idomain != domain && !strings.HasSuffix(idomain, "."+domain) {
+		return "", fmt.Errorf("identity %q is not within domain %s", identity, domain)
+	}
+	return identity, nil
+}
+
+// messageOptions returns copies of dkimopts for one message, which are
+// signed for domain instead of the VirtualHost domain if it is set.
+func messageOptions(dkimopts []*dkim.SignOptions, domain, identity string, lifetime time.Duration, now time.Time) []*dkim.SignOptions {
+	msgopts := make([]*dkim.SignOptions, len(dkimopts))
+	for idx, dkimopt := range dkimopts {
+		msgopt := *dkimopt
+		if domain != "" {
+			msgopt.Domain = domain
+		}
+		msgopt.Identifier = identity
+		if lifetime > 0 {
+			msgopt.Expiration = now.Add(lifetime)
+		}
+		msgopts[idx] = &msgopt
 	}
-	return key, err
+	return msgopts
 }
 
-func makeOptions(cfg *config, cfgvh *configVHost) (*dkim.SignOptions, error) {
+// oversignKeys lists every header field name of oversign one more time
+// than it is listed in keys, so that additional instances of these header
+// fields break the signature. Names not yet in keys are added to be signed.
+func oversignKeys(keys, oversign []string) []string {
+	result := append([]string(nil), keys...)
+	for _, name := range oversign {
+		found := false
+		for _, key := range keys {
+			if strings.EqualFold(key, name) {
+				// Keep the same spelling, some signers count
+				// header field names case-sensitively.
+				name, found = key, true
+				break
+			}
+		}
+		if !found {
+			result = append(result, name)
+		}
+		result = append(result, name)
+	}
+	return result
+}
+
+func makeOptions(cfg *config, cfgvh *configVHost) ([]*dkimSigner, error) {
 	if cfg == nil || cfgvh == nil {
 		return nil, fmt.Errorf("this should never happen")
 	}
 	if cfgvh.Domain == "" {
 		return nil, fmt.Errorf("no VirtualHost.Domain specified")
 	}
-	if cfgvh.Selector == "" {
-		return nil, fmt.Errorf("no VirtualHost.Selector specified")
+	domain, err := parentDomain(cfgvh.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VirtualHost.Domain: %s", err)
 	}
-	if cfgvh.PrivKeyPath == "" {
-		return nil, fmt.Errorf("no VirtualHost.PrivKeyPath specified")
+
+	signers := signerList(cfgvh)
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no VirtualHost.Selector or VirtualHost.Signers specified")
 	}
 
 	if len(cfgvh.HeaderKeys) == 0 {
 		cfgvh.HeaderKeys = cfg.HeaderKeys
 	}
+	if len(cfgvh.OversignHeaders) == 0 {
+		cfgvh.OversignHeaders = cfg.OversignHeaders
+	}
+	headerKeys := oversignKeys(cfgvh.HeaderKeys, cfgvh.OversignHeaders)
+
+	hash, err := parseHash(cfgvh.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VirtualHost.Hash: %s", err)
+	}
+	if cfgvh.Identity != "" {
+		if _, err := expandIdentity(cfgvh.Identity, domain, "user@"+domain); err != nil {
+			return nil, fmt.Errorf("invalid VirtualHost.Identity: %s", err)
+		}
+	}
+	if cfgvh.SignatureLifetime < 0 {
+		return nil, fmt.Errorf("invalid VirtualHost.SignatureLifetime: must not be negative")
+	}
+	if cfgvh.SignatureLifetime > 0 && cfgvh.SignatureLifetime < time.Minute {
+		return nil, fmt.Errorf("invalid VirtualHost.SignatureLifetime: must be at least one minute")
+	}
+	if cfgvh.BodyLength {
+		log.Warnf("VirtualHost %s: signatures with body length tag (l=) are rejected by some verifiers", cfgvh.Domain)
+	}
+
+	selectors := make(map[string]bool)
+	dkimsigners := make([]*dkimSigner, 0, len(signers))
+	for idx, signer := range signers {
+		if signer == nil || signer.Selector == "" {
+			return nil, fmt.Errorf("no Selector specified for signer #%d", idx)
+		}
+		if signer.PrivKeyPath == "" {
+			return nil, fmt.Errorf("no PrivKeyPath specified for signer #%d", idx)
+		}
+		if selectors[signer.Selector] {
+			return nil, fmt.Errorf("duplicate Selector %q for signer #%d", signer.Selector, idx)
+		}
+		selectors[signer.Selector] = true
+		if !signer.NotBefore.IsZero() && !signer.NotAfter.IsZero() &&
+			!signer.NotBefore.Before(signer.NotAfter) {
+			return nil, fmt.Errorf("NotBefore must be before NotAfter for signer #%d", idx)
+		}
+
+		passphrase, err := readPassphrase(signer.PrivKeyPassphrase, signer.PrivKeyPassphrasePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load PrivKeyPassphrasePath of signer #%d due to: %s", idx, err)
+		}
+		privkey, err := loadPrivKey(signer.PrivKeyPath, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load PrivKeyPath of signer #%d due to: %s", idx, err)
+		}
+		if _, err := keyAlgo(privkey); err != nil {
+			return nil, fmt.Errorf("unable to use PrivKeyPath of signer #%d due to: %s", idx, err)
+		}
+
+		dkimopt := &dkim.SignOptions{
+			Domain:                 domain,
+			Selector:               signer.Selector,
+			Signer:                 privkey,
+			Hash:                   hash,
+			HeaderCanonicalization: dkim.Canonicalization(cfgvh.HeaderCan),
+			BodyCanonicalization:   dkim.Canonicalization(cfgvh.BodyCan),
+			HeaderKeys:             headerKeys,
+		}
+		dkimsigners = append(dkimsigners, &dkimSigner{
+			Options:   dkimopt,
+			NotBefore: signer.NotBefore,
+			NotAfter:  signer.NotAfter,
+		})
+	}
+	return dkimsigners, nil
+}
+
+func signAll(w io.Writer, r io.Reader, dkimopts []*dkim.SignOptions, bodyLength bool) error {
+	if bodyLength {
+		return signAllBodyLength(w, r, dkimopts)
+	}
+
+	signers := make([]*dkim.Signer, 0, len(dkimopts))
+	defer func() {
+		for _, signer := range signers {
+			signer.Close()
+		}
+	}()
+
+	// We need to keep the message in a buffer so we can write the new
+	// DKIM-Signature header fields before the rest of the message
+	var b bytes.Buffer
+	writers := []io.Writer{&b}
+	for _, dkimopt := range dkimopts {
+		signer, err := dkim.NewSigner(dkimopt)
+		if err != nil {
+			return err
+		}
+		signers = append(signers, signer)
+		writers = append(writers, signer)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return err
+	}
+	for _, signer := range signers {
+		if err := signer.Close(); err != nil {
+			return err
+		}
+	}
+	for _, signer := range signers {
+		if _, err := io.WriteString(w, signer.Signature()); err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(w, &b)
+	return err
+}
 
-	privkey, err := loadPrivKey(cfgvh.PrivKeyPath)
+func utilOptions(dkimopt *dkim.SignOptions) *dkimutil.SignOptions {
+	return &dkimutil.SignOptions{
+		Domain:                 dkimopt.Domain,
+		Selector:               dkimopt.Selector,
+		Identifier:             dkimopt.Identifier,
+		Signer:                 dkimopt.Signer,
+		Hash:                   dkimopt.Hash,
+		HeaderCanonicalization: string(dkimopt.HeaderCanonicalization),
+		BodyCanonicalization:   string(dkimopt.BodyCanonicalization),
+		HeaderKeys:             dkimopt.HeaderKeys,
+		Expiration:             dkimopt.Expiration,
+	}
+}
+
+// lookupTXT looks up DNS TXT records for the validation of existing
+// signatures, for which the system resolver is used.
+func lookupTXT(domain string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return net.DefaultResolver.LookupTXT(ctx, domain)
+}
+
+// signAllBodyLength signs using dkimutil, because go-msgauth does not
+// support the body length (l=) tag.
+func signAllBodyLength(w io.Writer, r io.Reader, dkimopts []*dkim.SignOptions) error {
+	msg, err := ioutil.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("unable to load VirtualHost.PrivKeyPath due to: %s", err)
+		return err
+	}
+	m, err := dkimutil.ParseMessage(msg)
+	if err != nil {
+		return err
 	}
 
-	dkimopt := &dkim.SignOptions{
-		Domain:                 cfgvh.Domain,
-		Selector:               cfgvh.Selector,
-		Signer:                 privkey,
-		Hash:                   crypto.SHA256,
-		HeaderCanonicalization: dkim.Canonicalization(cfgvh.HeaderCan),
-		BodyCanonicalization:   dkim.Canonicalization(cfgvh.BodyCan),
-		HeaderKeys:             cfgvh.HeaderKeys,
+	now := time.Now()
+	for _, dkimopt := range dkimopts {
+		opts := utilOptions(dkimopt)
+		opts.BodyLength = true
+		sig, err := dkimutil.Sign(m, opts, now)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, sig); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// configuredTXT returns a TXT lookup for the keys of dkimopts.
+func configuredTXT(dkimopts []*dkim.SignOptions) (func(domain string) ([]string, error), error) {
+	records := make(map[string]string)
+	for _, dkimopt := range dkimopts {
+		record, err := dkimRecord(dkimopt.Signer.Public())
+		if err != nil {
+			return nil, err
+		}
+		records[dkimopt.Selector+"._domainkey."+dkimopt.Domain] = record
+	}
+	return func(domain string) ([]string, error) {
+		record, found := records[domain]
+		if !found {
+			return nil, fmt.Errorf("no configured key for %s", domain)
+		}
+		return []string{record}, nil
+	}, nil
+}
+
+// verifyAll verifies the new signatures for dkimopts using the configured
+// keys. It uses dkimutil, as go-msgauth rejects the body length (l=) tag.
+func verifyAll(msg []byte, dkimopts []*dkim.SignOptions) error {
+	lookupTXT, err := configuredTXT(dkimopts)
+	if err != nil {
+		return err
+	}
+
+	m, err := dkimutil.ParseMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	// The new DKIM-Signature header fields are in front of any existing
+	// ones, so only those need to be verified using the configured keys.
+	fields := m.Header.SignatureFields(dkimutil.SignatureFieldName)
+	if len(fields) < len(dkimopts) {
+		return fmt.Errorf("found %d of %d signatures", len(fields), len(dkimopts))
+	}
+	for idx, field := range fields[:len(dkimopts)] {
+		res := dkimutil.Verify(m, field, lookupTXT)
+		if res.Err != nil {
+			return fmt.Errorf("signature #%d for %s did not verify: %s", idx, res.Domain, res.Err)
+		}
 	}
-	return dkimopt, nil
+	return nil
 }
@@ -0,0 +1,145 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	dkim "github.com/emersion/go-msgauth/dkim"
+	"github.com/mback2k/smtp-dkim-signer/internal/dkimutil"
+)
+
+func checkRecord(txt string, dkimopt *dkim.SignOptions) (warnings []string, err error) {
+	rec, err := dkimutil.ParseKeyRecord(txt)
+	if err != nil {
+		return nil, err
+	}
+
+	algo, err := keyAlgo(dkimopt.Signer)
+	if err != nil {
+		return nil, err
+	}
+	if rec.KeyAlgo != algo {
+		return nil, fmt.Errorf("key algorithm k=%s does not match configured %s key", rec.KeyAlgo, algo)
+	}
+	if !dkimutil.EqualPublicKeys(dkimopt.Signer.Public(), rec.PublicKey) {
+		return nil, fmt.Errorf("public key p= does not match configured private key")
+	}
+
+	if rec.HashAlgos != nil && !dkimutil.ContainsValue(rec.HashAlgos, "sha256") {
+		return nil, fmt.Errorf("hash algorithms h=%s do not allow sha256", strings.Join(rec.HashAlgos, ":"))
+	}
+	if rec.Services != nil && !dkimutil.ContainsValue(rec.Services, "email") &&
+		!dkimutil.ContainsValue(rec.Services, "*") {
+		return nil, fmt.Errorf("service types s=%s do not allow email", strings.Join(rec.Services, ":"))
+	}
+	if dkimutil.ContainsValue(rec.Flags, "y") {
+		warnings = append(warnings, "record is in testing mode (t=y)")
+	}
+	if dkimutil.ContainsValue(rec.Flags, "s") && dkimopt.Identifier != "" &&
+		!strings.HasSuffix(strings.ToLower(dkimopt.Identifier), "@"+strings.ToLower(dkimopt.Domain)) {
+		return nil, fmt.Errorf("strict flag t=s forbids identity %s outside of %s", dkimopt.Identifier, dkimopt.Domain)
+	}
+	return warnings, nil
+}
+
+func makeResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func runDNSCheck(args []string) error {
+	fs := flag.NewFlagSet("dns-check", flag.ExitOnError)
+	resolver := fs.String("resolver", "", "DNS resolver address (default system resolver)")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout for each DNS lookup")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	res := makeResolver(*resolver)
+	now := time.Now()
+	failed := 0
+	for idx, cfgvh := range cfg.VirtualHosts {
+		signers, err := makeOptions(cfg, cfgvh)
+		if err != nil {
+			return fmt.Errorf("unable to setup VirtualHost #%d due to: %s", idx, err)
+		}
+		// Signers of a wildcard VirtualHost are checked for its parent domain.
+		domain := signers[0].Options.Domain
+		var identity string
+		if cfgvh.Identity != "" {
+			identity, err = expandIdentity(cfgvh.Identity, domain, "user@"+domain)
+			if err != nil {
+				return fmt.Errorf("unable to setup VirtualHost #%d due to: %s", idx, err)
+			}
+		}
+		for _, signer := range signers {
+			dkimopt := messageOptions([]*dkim.SignOptions{signer.Options}, "", identity, 0, now)[0]
+			name := dkimopt.Selector + "._domainkey." + dkimopt.Domain
+			status := ""
+			if !signer.activeAt(now) {
+				status = " (inactive)"
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			txts, err := res.LookupTXT(ctx, name)
+			cancel()
+			if err != nil {
+				fmt.Printf("FAIL %s%s: lookup failed: %s\n", name, status, err)
+				failed++
+				continue
+			}
+
+			warnings, err := checkRecord(strings.Join(txts, ""), dkimopt)
+			if err != nil {
+				fmt.Printf("FAIL %s%s: %s\n", name, status, err)
+				failed++
+				continue
+			}
+			for _, warning := range warnings {
+				fmt.Printf("WARN %s%s: %s\n", name, status, warning)
+			}
+			fmt.Printf("OK   %s%s\n", name, status)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d DKIM record(s) do not match the configuration", failed)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package dkimutil
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header field names of an ARC set as defined in RFC 8617.
+const (
+	ARCSealFieldName                  = "ARC-Seal"
+	ARCMessageSignatureFieldName      = "ARC-Message-Signature"
+	ARCAuthenticationResultsFieldName = "ARC-Authentication-Results"
+)
+
+// MaxARCInstance is the highest allowed ARC instance number.
+const MaxARCInstance = 50
+
+// Chain validation status values of the cv= tag.
+const (
+	ChainNone = "none"
+	ChainPass = "pass"
+	ChainFail = "fail"
+)
+
+// ARCSet holds the raw header fields of one ARC set.
+type ARCSet struct {
+	Instance int
+	AAR      string
+	AMS      string
+	AS       string
+}
+
+func parseInstance(s string) (int, error) {
+	instance, err := strconv.Atoi(StripWhitespace(s))
+	if err != nil || instance < 1 || instance > MaxARCInstance {
+		return 0, fmt.Errorf("malformed instance i=%s", s)
+	}
+	return instance, nil
+}
+
+// fieldInstance returns the instance of an ARC header field. It is the
+// leading i= tag of an ARC-Authentication-Results value, whose remainder is
+// not a tag list, and the i= tag of the tag list of the other fields.
+func fieldInstance(kv string) (int, error) {
+	k, v := ParseField(kv)
+	if strings.EqualFold(k, ARCAuthenticationResultsFieldName) {
+		tag := strings.SplitN(strings.SplitN(v, ";", 2)[0], "=", 2)
+		if len(tag) != 2 || StripWhitespace(tag[0]) != "i" {
+			return 0, fmt.Errorf("missing instance tag in %q", v)
+		}
+		return parseInstance(tag[1])
+	}
+	tags, err := ParseTags(v)
+	if err != nil {
+		return 0, fmt.Errorf("malformed %s tags: %s", k, err)
+	}
+	instance, found := tags["i"]
+	if !found {
+		return 0, fmt.Errorf("missing instance tag in %q", v)
+	}
+	return parseInstance(instance)
+}
+
+// ARCSets returns the ARC sets of h ordered by instance. It fails if the
+// sets are incomplete, duplicated or not numbered consecutively from 1.
+func (h Header) ARCSets() ([]*ARCSet, error) {
+	sets := make(map[int]*ARCSet)
+	for _, kv := range h {
+		k, _ := ParseField(kv)
+		if !strings.EqualFold(k, ARCAuthenticationResultsFieldName) &&
+			!strings.EqualFold(k, ARCMessageSignatureFieldName) &&
+			!strings.EqualFold(k, ARCSealFieldName) {
+			continue
+		}
+		instance, err := fieldInstance(kv)
+		if err != nil {
+			return nil, err
+		}
+		set, found := sets[instance]
+		if !found {
+			set = &ARCSet{Instance: instance}
+			sets[instance] = set
+		}
+
+		field := &set.AS
+		if strings.EqualFold(k, ARCAuthenticationResultsFieldName) {
+			field = &set.AAR
+		} else if strings.EqualFold(k, ARCMessageSignatureFieldName) {
+			field = &set.AMS
+		}
+		if *field != "" {
+			return nil, fmt.Errorf("duplicate %s header field for instance %d", k, instance)
+		}
+		*field = kv
+	}
+
+	list := make([]*ARCSet, len(sets))
+	for i := range list {
+		set, found := sets[i+1]
+		if !found {
+			return nil, fmt.Errorf("missing ARC set for instance %d", i+1)
+		}
+		if set.AAR == "" || set.AMS == "" || set.AS == "" {
+			return nil, fmt.Errorf("incomplete ARC set for instance %d", i+1)
+		}
+		list[i] = set
+	}
+	return list, nil
+}
+
+// sealHashInput returns the data covered by an ARC-Seal: the header fields
+// of all given sets in instance order followed by seal, which must already
+// have an empty b= tag, without its trailing CRLF.
+func sealHashInput(sets []*ARCSet, aar, ams, seal string) []byte {
+	var b strings.Builder
+	for _, set := range sets {
+		b.WriteString(CanonicalizeHeader(set.AAR, CanonicalizationRelaxed))
+		b.WriteString(CanonicalizeHeader(set.AMS, CanonicalizationRelaxed))
+		b.WriteString(CanonicalizeHeader(set.AS, CanonicalizationRelaxed))
+	}
+	b.WriteString(CanonicalizeHeader(aar, CanonicalizationRelaxed))
+	b.WriteString(CanonicalizeHeader(ams, CanonicalizationRelaxed))
+	seal = CanonicalizeHeader(seal, CanonicalizationRelaxed)
+	b.WriteString(strings.TrimRight(seal, crlf))
+	return []byte(b.String())
+}
+
+func verifySeal(sets []*ARCSet, lookupTXT func(domain string) ([]string, error)) error {
+	last := sets[len(sets)-1]
+	_, value := ParseField(last.AS)
+	tags, err := ParseTags(value)
+	if err != nil {
+		return fmt.Errorf("malformed seal tags: %s", err)
+	}
+	for _, tag := range []string{"a", "b", "cv", "d", "i", "s"} {
+		if _, found := tags[tag]; !found {
+			return fmt.Errorf("seal missing required tag %s=", tag)
+		}
+	}
+	if _, found := tags["h"]; found {
+		return fmt.Errorf("seal must not have a h= tag")
+	}
+
+	algos := strings.SplitN(StripWhitespace(tags["a"]), "-", 2)
+	if len(algos) != 2 {
+		return fmt.Errorf("malformed algorithm a=%s", tags["a"])
+	}
+	hash, err := hashByName(algos[1])
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(StripWhitespace(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("malformed signature: %s", err)
+	}
+
+	key, err := lookupKey(StripWhitespace(tags["d"]), StripWhitespace(tags["s"]), algos[0], algos[1], lookupTXT)
+	if err != nil {
+		return err
+	}
+	hasher := hash.New()
+	hasher.Write(sealHashInput(sets[:len(sets)-1], last.AAR, last.AMS, RemoveSignatureValue(last.AS)))
+	return VerifySignature(key.PublicKey, hash, hasher.Sum(nil), sig)
+}
+
+// ChainValue returns the cv= tag of the ARC-Seal of set.
+func (set *ARCSet) ChainValue() string {
+	_, value := ParseField(set.AS)
+	tags, err := ParseTags(value)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(StripWhitespace(tags["cv"]))
+}
+
+// ValidateARCChain validates the ARC chain of m as described in RFC 8617
+// section 5.2 and returns the resulting chain validation status together
+// with the existing sets, which are nil if they could not be parsed.
+// The error describes why the chain failed.
+func ValidateARCChain(m *Message, lookupTXT func(domain string) ([]string, error)) (string, []*ARCSet, error) {
+	sets, err := m.Header.ARCSets()
+	if err != nil {
+		return ChainFail, nil, err
+	}
+	if len(sets) == 0 {
+		return ChainNone, nil, nil
+	}
+	for _, set := range sets {
+		expected := ChainPass
+		if set.Instance == 1 {
+			expected = ChainNone
+		}
+		if cv := set.ChainValue(); cv != expected {
+			return ChainFail, sets, fmt.Errorf("instance %d has cv=%s instead of cv=%s", set.Instance, cv, expected)
+		}
+	}
+
+	// Only the most recent ARC-Message-Signature has to validate, as every
+	// intermediary may have modified the message after the previous ones.
+	last := sets[len(sets)-1]
+	if res := Verify(m, last.AMS, lookupTXT); res.Err != nil {
+		return ChainFail, sets, fmt.Errorf("message signature of instance %d did not verify: %s", last.Instance, res.Err)
+	}
+	for i := len(sets); i > 0; i-- {
+		if err := verifySeal(sets[:i], lookupTXT); err != nil {
+			return ChainFail, sets, fmt.Errorf("seal of instance %d did not verify: %s", i, err)
+		}
+	}
+	return ChainPass, sets, nil
+}
+
+// SealARC creates the next ARC set for m, whose existing ARC sets and their
+// chain validation status cv are given, using the key and canonicalization
+// of options. The identity, expiration and body length options are not used.
+// results is the authentication results payload of the ARC-Authentication-Results
+// header field, starting with the authentication service identifier.
+// If cv is fail, the seal only covers the new set (RFC 8617 section 5.1.2).
+// A chain whose most recent set already has cv=fail is not sealed again.
+// The header fields are returned in the order they are to be prepended.
+func SealARC(m *Message, sets []*ARCSet, cv string, results string, options *SignOptions, now time.Time) (string, error) {
+	instance := len(sets) + 1
+	if instance > MaxARCInstance {
+		return "", fmt.Errorf("too many ARC sets")
+	}
+	if len(sets) > 0 && sets[len(sets)-1].ChainValue() == ChainFail {
+		return "", fmt.Errorf("ARC chain already failed at instance %d", len(sets))
+	}
+	keyAlgo, err := KeyAlgo(options.Signer.Public())
+	if err != nil {
+		return "", err
+	}
+	if options.Hash != crypto.SHA256 {
+		return "", fmt.Errorf("unsupported hash algorithm")
+	}
+	headerCan := options.HeaderCanonicalization
+	if headerCan == "" {
+		headerCan = CanonicalizationSimple
+	}
+	bodyCan := options.BodyCanonicalization
+	if bodyCan == "" {
+		bodyCan = CanonicalizationSimple
+	}
+	if !ValidCanonicalization(headerCan) || !ValidCanonicalization(bodyCan) {
+		return "", fmt.Errorf("unknown canonicalization %s/%s", headerCan, bodyCan)
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	aar := ARCAuthenticationResultsFieldName + ": i=" + strconv.Itoa(instance) + "; " + results + crlf
+
+	bodyHash, _ := BodyHash(m.Body, bodyCan, options.Hash, -1)
+	ams, err := SignFields(m.Header, ARCMessageSignatureFieldName, []Tag{
+		{"i", strconv.Itoa(instance)},
+		{"a", keyAlgo + "-sha256"},
+		{"c", headerCan + "/" + bodyCan},
+		{"d", options.Domain},
+		{"s", options.Selector},
+		{"t", timestamp},
+		{"h", strings.Join(options.HeaderKeys, ":")},
+		{"bh", base64.StdEncoding.EncodeToString(bodyHash)},
+	}, options.HeaderKeys, headerCan, options.Signer, options.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	tags := []Tag{
+		{"i", strconv.Itoa(instance)},
+		{"a", keyAlgo + "-sha256"},
+		{"t", timestamp},
+		{"cv", cv},
+		{"d", options.Domain},
+		{"s", options.Selector},
+	}
+	sealed := sets
+	if cv == ChainFail {
+		sealed = nil
+	}
+	sig, err := SignData(options.Signer, options.Hash, sealHashInput(sealed, aar, ams, FormatField(ARCSealFieldName, tags, "")))
+	if err != nil {
+		return "", err
+	}
+	seal := FormatField(ARCSealFieldName, tags, base64.StdEncoding.EncodeToString(sig))
+
+	var b bytes.Buffer
+	b.WriteString(seal)
+	b.WriteString(ams)
+	b.WriteString(aar)
+	return b.String(), nil
+}
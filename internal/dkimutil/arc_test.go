@@ -0,0 +1,167 @@
+package dkimutil
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// arcHop validates the ARC chain of msg and prepends the next ARC set as an
+// intermediary would. It returns the sealed message and the chain status.
+func arcHop(t *testing.T, msg string, key crossCheckKey, results string) (string, string) {
+	t.Helper()
+	m, err := ParseMessage([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cv, sets, _ := ValidateARCChain(m, lookupRecord(key.record))
+	seal, err := SealARC(m, sets, cv, results, arcSignOptions(key), time.Now())
+	if err != nil {
+		t.Fatalf("SealARC() failed: %s", err)
+	}
+	return seal + msg, cv
+}
+
+func arcSignOptions(key crossCheckKey) *SignOptions {
+	return &SignOptions{
+		Domain:                 "example.com",
+		Selector:               "test",
+		Signer:                 key.signer,
+		Hash:                   crypto.SHA256,
+		HeaderCanonicalization: CanonicalizationRelaxed,
+		BodyCanonicalization:   CanonicalizationRelaxed,
+		HeaderKeys:             crossCheckHeaderKeys,
+	}
+}
+
+func validateARC(t *testing.T, msg string, key crossCheckKey) (string, []*ARCSet, error) {
+	t.Helper()
+	m, err := ParseMessage([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ValidateARCChain(m, lookupRecord(key.record))
+}
+
+// TestSealARCChain checks that every hop of a chain validates the sets of
+// the previous hops, including a header field added in between.
+func TestSealARCChain(t *testing.T) {
+	key := crossCheckKeys(t)[0]
+	msg := crossCheckMessage
+	for hop := 1; hop <= 3; hop++ {
+		var cv string
+		msg, cv = arcHop(t, msg, key, "mx.example.com; dkim=none")
+		want := ChainPass
+		if hop == 1 {
+			want = ChainNone
+		}
+		if cv != want {
+			t.Errorf("hop %d sealed cv=%s, want cv=%s", hop, cv, want)
+		}
+		msg = fmt.Sprintf("Received: from hop%d.example.com\r\n", hop) + msg
+
+		cv, sets, err := validateARC(t, msg, key)
+		if cv != ChainPass || err != nil {
+			t.Fatalf("ValidateARCChain() after hop %d = %s, %v", hop, cv, err)
+		}
+		if len(sets) != hop {
+			t.Fatalf("ValidateARCChain() after hop %d found %d sets", hop, len(sets))
+		}
+	}
+}
+
+// TestSealARCFailedChain checks that a chain failing validation is sealed
+// with cv=fail covering only the new set, and that it is not sealed again.
+func TestSealARCFailedChain(t *testing.T) {
+	key := crossCheckKeys(t)[0]
+	msg, _ := arcHop(t, crossCheckMessage, key, "mx.example.com; dkim=none")
+	msg = strings.Replace(msg, "hungry", "thirsty", 1)
+
+	msg, cv := arcHop(t, msg, key, "mx.example.com; dkim=none")
+	if cv != ChainFail {
+		t.Fatalf("tampered chain sealed with cv=%s, want cv=%s", cv, ChainFail)
+	}
+	cv, sets, err := validateARC(t, msg, key)
+	if cv != ChainFail || err == nil {
+		t.Errorf("ValidateARCChain() = %s, %v, want %s", cv, err, ChainFail)
+	}
+	if len(sets) != 2 || sets[1].ChainValue() != ChainFail {
+		t.Fatalf("ValidateARCChain() found sets %+v, want a second set with cv=fail", sets)
+	}
+	if err := verifySeal(sets[1:], lookupRecord(key.record)); err != nil {
+		t.Errorf("seal with cv=fail does not verify over its own set: %s", err)
+	}
+	if err := verifySeal(sets, lookupRecord(key.record)); err == nil {
+		t.Errorf("seal with cv=fail verifies over the previous set")
+	}
+
+	m, err := ParseMessage([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SealARC(m, sets, ChainFail, "mx.example.com; dkim=none", arcSignOptions(key), time.Now()); err == nil {
+		t.Errorf("SealARC() sealed a chain whose last set has cv=fail")
+	}
+}
+
+// TestARCSetsResultsInstance checks that the instance of an
+// ARC-Authentication-Results header field is only taken from its leading
+// tag and not from the results.
+func TestARCSetsResultsInstance(t *testing.T) {
+	header := Header{
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; d=example.com; s=test; b=\r\n",
+		"ARC-Message-Signature: i=1; a=rsa-sha256; d=example.com; s=test; h=From; bh=; b=\r\n",
+		"ARC-Authentication-Results: i=1; mx.example.com;\r\n dkim=pass header.i=@example.com header.s=test; x-i=2\r\n",
+	}
+	sets, err := header.ARCSets()
+	if err != nil {
+		t.Fatalf("ARCSets() failed: %s", err)
+	}
+	if len(sets) != 1 || sets[0].AAR != header[2] {
+		t.Errorf("ARCSets() = %+v, want one set with the results", sets)
+	}
+
+	header[2] = "ARC-Authentication-Results: mx.example.com; i=1; dkim=pass\r\n"
+	if _, err := header.ARCSets(); err == nil {
+		t.Errorf("ARCSets() accepted results without a leading instance tag")
+	}
+}
+
+// TestValidateARCChainTampered checks that a modified ARC-Message-Signature
+// or ARC-Seal of any instance breaks the chain.
+func TestValidateARCChainTampered(t *testing.T) {
+	key := crossCheckKeys(t)[0]
+	msg, _ := arcHop(t, crossCheckMessage, key, "mx.example.com; dkim=none")
+	msg, _ = arcHop(t, msg, key, "mx.example.com; dkim=none")
+
+	for _, tc := range []struct {
+		name     string
+		field    string
+		instance int
+	}{
+		{"AMS", ARCMessageSignatureFieldName, 2},
+		{"AS", ARCSealFieldName, 1},
+		{"AS", ARCSealFieldName, 2},
+	} {
+		m, err := ParseMessage([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tampered := false
+		for idx, kv := range m.Header {
+			k, _ := ParseField(kv)
+			if instance, _ := fieldInstance(kv); k == tc.field && instance == tc.instance {
+				m.Header[idx] = strings.Replace(kv, " t=", " t=1", 1)
+				tampered = true
+			}
+		}
+		if !tampered {
+			t.Fatalf("%s of instance %d not found", tc.name, tc.instance)
+		}
+		if cv, _, err := ValidateARCChain(m, lookupRecord(key.record)); cv != ChainFail || err == nil {
+			t.Errorf("ValidateARCChain() with a tampered %s of instance %d = %s, %v, want %s", tc.name, tc.instance, cv, err, ChainFail)
+		}
+	}
+}
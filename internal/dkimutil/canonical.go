@@ -0,0 +1,85 @@
+package dkimutil
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+const (
+	CanonicalizationSimple  = "simple"
+	CanonicalizationRelaxed = "relaxed"
+
+	crlf = "\r\n"
+)
+
+var (
+	rxReduceWS  = regexp.MustCompile(`[ \t\r\n]+`)
+	rxReduceWSP = regexp.MustCompile(`[ \t]+`)
+)
+
+// ParseCanonicalization splits the value of a c= tag into the header and
+// body canonicalization algorithms, defaulting to simple for both.
+func ParseCanonicalization(s string) (headerCan, bodyCan string) {
+	headerCan = CanonicalizationSimple
+	bodyCan = CanonicalizationSimple
+
+	cans := strings.SplitN(StripWhitespace(s), "/", 2)
+	if cans[0] != "" {
+		headerCan = cans[0]
+	}
+	if len(cans) > 1 && cans[1] != "" {
+		bodyCan = cans[1]
+	}
+	return
+}
+
+// ValidCanonicalization reports whether can is a known algorithm.
+func ValidCanonicalization(can string) bool {
+	return can == CanonicalizationSimple || can == CanonicalizationRelaxed
+}
+
+// CanonicalizeHeader canonicalizes a complete header field including its
+// trailing CRLF as described in RFC 6376 section 3.4.
+func CanonicalizeHeader(kv string, can string) string {
+	if can != CanonicalizationRelaxed {
+		return kv
+	}
+
+	kvs := strings.SplitN(kv, ":", 2)
+	k := strings.TrimSpace(strings.ToLower(kvs[0]))
+	var v string
+	if len(kvs) > 1 {
+		v = strings.TrimSpace(rxReduceWS.ReplaceAllString(kvs[1], " "))
+	}
+	return k + ":" + v + crlf
+}
+
+// CanonicalizeBody canonicalizes a message body as described in
+// RFC 6376 section 3.4. Lone LF line endings are treated as CRLF.
+func CanonicalizeBody(body []byte, can string) []byte {
+	lines := bytes.Split(body, []byte("\n"))
+	for i, line := range lines {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if can == CanonicalizationRelaxed {
+			line = rxReduceWSP.ReplaceAll(line, []byte(" "))
+			line = bytes.TrimRight(line, " ")
+		}
+		lines[i] = line
+	}
+
+	n := len(lines)
+	for n > 0 && len(lines[n-1]) == 0 {
+		n--
+	}
+
+	var b bytes.Buffer
+	for _, line := range lines[:n] {
+		b.Write(line)
+		b.WriteString(crlf)
+	}
+	if b.Len() == 0 && can != CanonicalizationRelaxed {
+		b.WriteString(crlf)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,54 @@
+package dkimutil
+
+import (
+	"crypto"
+	"regexp"
+	"strings"
+)
+
+var rxSignatureValue = regexp.MustCompile(`(^[^:]*:|;)(\s*b\s*=)[^;]*`)
+
+// BodyHash canonicalizes body and hashes its first length bytes, or all of
+// it if length is negative. It also returns the full canonical body length.
+func BodyHash(body []byte, can string, hash crypto.Hash, length int64) ([]byte, int64) {
+	canonical := CanonicalizeBody(body, can)
+	total := int64(len(canonical))
+	if length >= 0 && length < total {
+		canonical = canonical[:length]
+	}
+	hasher := hash.New()
+	hasher.Write(canonical)
+	return hasher.Sum(nil), total
+}
+
+// HeaderHashInput returns the canonicalized header data covered by a
+// signature: the header fields selected by keys followed by sigField,
+// which must already have an empty b= tag, without its trailing CRLF.
+func HeaderHashInput(h Header, keys []string, sigField string, can string) []byte {
+	var b strings.Builder
+	picker := NewPicker(h)
+	for _, key := range keys {
+		kv := picker.Pick(key)
+		if kv == "" {
+			// Header field names listed more often than present in the
+			// message do not contribute to the hash (oversigning).
+			continue
+		}
+		b.WriteString(CanonicalizeHeader(kv, can))
+	}
+	sigField = CanonicalizeHeader(sigField, can)
+	b.WriteString(strings.TrimRight(sigField, crlf))
+	return []byte(b.String())
+}
+
+// HeaderHash hashes the output of HeaderHashInput.
+func HeaderHash(h Header, keys []string, sigField string, can string, hash crypto.Hash) []byte {
+	hasher := hash.New()
+	hasher.Write(HeaderHashInput(h, keys, sigField, can))
+	return hasher.Sum(nil)
+}
+
+// RemoveSignatureValue empties the b= tag of a signature header field.
+func RemoveSignatureValue(field string) string {
+	return rxSignatureValue.ReplaceAllString(field, "$1$2")
+}
@@ -0,0 +1,158 @@
+package dkimutil
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Header is a list of raw header fields in message order, each including
+// its continuation lines and the trailing CRLF.
+type Header []string
+
+// Message is a message split into its header fields and body.
+type Message struct {
+	Header Header
+	Body   []byte
+}
+
+// ParseMessage splits a raw message into its header fields and body.
+func ParseMessage(b []byte) (*Message, error) {
+	var h Header
+	for len(b) > 0 {
+		idx := bytes.IndexByte(b, '\n')
+		if idx < 0 {
+			return nil, fmt.Errorf("failed to read header: missing empty line after header")
+		}
+		line := strings.TrimSuffix(string(b[:idx]), "\r")
+		b = b[idx+1:]
+
+		if len(line) == 0 {
+			return &Message{Header: h, Body: b}, nil
+		} else if line[0] == ' ' || line[0] == '\t' {
+			if len(h) == 0 {
+				return nil, fmt.Errorf("failed to read header: continuation line without header field")
+			}
+			h[len(h)-1] += line + crlf
+		} else {
+			if !strings.Contains(line, ":") {
+				return nil, fmt.Errorf("failed to read header: malformed header field %q", line)
+			}
+			h = append(h, line+crlf)
+		}
+	}
+	return &Message{Header: h}, nil
+}
+
+// Bytes returns the header fields followed by the empty separator line.
+func (h Header) Bytes() []byte {
+	var b bytes.Buffer
+	for _, kv := range h {
+		b.WriteString(kv)
+	}
+	b.WriteString(crlf)
+	return b.Bytes()
+}
+
+// Values returns the unfolded values of all header fields named key.
+func (h Header) Values(key string) []string {
+	var values []string
+	for _, kv := range h {
+		k, v := ParseField(kv)
+		if strings.EqualFold(k, key) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ParseField splits a raw header field into its name and unfolded value.
+func ParseField(kv string) (k string, v string) {
+	kvs := strings.SplitN(kv, ":", 2)
+	k = strings.TrimSpace(kvs[0])
+	if len(kvs) > 1 {
+		v = strings.TrimSpace(rxReduceWS.ReplaceAllString(kvs[1], " "))
+	}
+	return
+}
+
+// Picker selects header fields for signing from the bottom of the header
+// upwards, as required by RFC 6376 section 5.4.2.
+type Picker struct {
+	h      Header
+	picked map[string]int
+}
+
+// NewPicker creates a new picker for the header fields h.
+func NewPicker(h Header) *Picker {
+	return &Picker{
+		h:      h,
+		picked: make(map[string]int),
+	}
+}
+
+// Pick returns the next unpicked instance of the header field named key,
+// or an empty string if there is none left.
+func (p *Picker) Pick(key string) string {
+	key = strings.ToLower(key)
+	at := p.picked[key]
+	for i := len(p.h) - 1; i >= 0; i-- {
+		k, _ := ParseField(p.h[i])
+		if !strings.EqualFold(k, key) {
+			continue
+		}
+		if at == 0 {
+			p.picked[key]++
+			return p.h[i]
+		}
+		at--
+	}
+	return ""
+}
+
+// ParseTags parses a DKIM tag-value list such as a DKIM-Signature value
+// or a DKIM key record.
+func ParseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed tag %q", strings.TrimSpace(tag))
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+// ParseTagList splits a colon-separated tag value such as h=.
+func ParseTagList(s string) []string {
+	values := strings.Split(s, ":")
+	for i, value := range values {
+		values[i] = StripWhitespace(value)
+	}
+	return values
+}
+
+// ContainsValue reports whether values contains value, ignoring case.
+func ContainsValue(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripWhitespace removes all whitespace from s.
+func StripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,108 @@
+package dkimutil
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// KeyRecord is a parsed DKIM key record as published in DNS.
+type KeyRecord struct {
+	Version   string
+	KeyAlgo   string
+	PublicKey crypto.PublicKey
+	HashAlgos []string
+	Services  []string
+	Flags     []string
+}
+
+// ParseKeyRecord parses the concatenated TXT record of a DKIM selector.
+func ParseKeyRecord(txt string) (*KeyRecord, error) {
+	tags, err := ParseTags(txt)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &KeyRecord{Version: tags["v"], KeyAlgo: tags["k"]}
+	if rec.Version != "" && rec.Version != "DKIM1" {
+		return nil, fmt.Errorf("incompatible version v=%s", rec.Version)
+	}
+	if rec.KeyAlgo == "" {
+		rec.KeyAlgo = "rsa"
+	}
+	if h, found := tags["h"]; found {
+		rec.HashAlgos = ParseTagList(h)
+	}
+	if s, found := tags["s"]; found {
+		rec.Services = ParseTagList(s)
+	}
+	if t, found := tags["t"]; found {
+		rec.Flags = ParseTagList(t)
+	}
+
+	p, found := tags["p"]
+	if !found {
+		return nil, fmt.Errorf("missing public key data (p=)")
+	}
+	p = StripWhitespace(p)
+	if p == "" {
+		return nil, fmt.Errorf("key is revoked (empty p=)")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key data: %s", err)
+	}
+
+	switch rec.KeyAlgo {
+	case "rsa":
+		pubkey, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			pubkey, err = x509.ParsePKCS1PublicKey(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RSA public key: %s", err)
+			}
+		}
+		if _, ok := pubkey.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("not an RSA public key")
+		}
+		rec.PublicKey = pubkey
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 public key size: %d bytes", len(der))
+		}
+		rec.PublicKey = ed25519.PublicKey(der)
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm k=%s", rec.KeyAlgo)
+	}
+	return rec, nil
+}
+
+// EqualPublicKeys reports whether a and b are the same RSA or Ed25519 key.
+func EqualPublicKeys(a, b crypto.PublicKey) bool {
+	switch a := a.(type) {
+	case *rsa.PublicKey:
+		return a.Equal(b)
+	case ed25519.PublicKey:
+		return a.Equal(b)
+	default:
+		return false
+	}
+}
+
+// VerifySignature checks a signature over hashed header data.
+func VerifySignature(pubkey crypto.PublicKey, hash crypto.Hash, hashed, sig []byte) error {
+	switch pubkey := pubkey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pubkey, hash, hashed, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pubkey, hashed, sig) {
+			return fmt.Errorf("ed25519: verification error")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key algorithm %T", pubkey)
+	}
+}
@@ -0,0 +1,153 @@
+package dkimutil
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignOptions configures Sign. Unlike the signer of go-msgauth it supports
+// the body length (l=) tag.
+type SignOptions struct {
+	Domain     string
+	Selector   string
+	Identifier string
+
+	Signer crypto.Signer
+	Hash   crypto.Hash
+
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+	HeaderKeys             []string
+
+	Expiration time.Time
+	BodyLength bool
+}
+
+// Tag is a single tag=value pair of a signature header field.
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// KeyAlgo returns the DKIM key algorithm name of pubkey.
+func KeyAlgo(pubkey crypto.PublicKey) (string, error) {
+	switch pubkey.(type) {
+	case *rsa.PublicKey:
+		return "rsa", nil
+	case ed25519.PublicKey:
+		return "ed25519", nil
+	default:
+		return "", fmt.Errorf("unsupported key algorithm %T", pubkey)
+	}
+}
+
+// SignData hashes data and signs the digest, as used for the b= tag.
+func SignData(signer crypto.Signer, hash crypto.Hash, data []byte) ([]byte, error) {
+	hasher := hash.New()
+	hasher.Write(data)
+	hashed := hasher.Sum(nil)
+
+	// Ed25519 signs the digest itself (RFC 8463) and refuses a hash option.
+	opts := crypto.SignerOpts(hash)
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	return signer.Sign(rand.Reader, hashed, opts)
+}
+
+// FormatField formats a signature header field with the given tags and
+// a trailing b= tag holding sig, folding long lines.
+func FormatField(name string, tags []Tag, sig string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString(":")
+	line := len(name) + 1
+	for _, tag := range tags {
+		t := " " + tag.Name + "=" + tag.Value + ";"
+		if line+len(t) > 76 && line > len(name)+1 {
+			b.WriteString(crlf)
+			line = 0
+		}
+		b.WriteString(t)
+		line += len(t)
+	}
+	b.WriteString(crlf)
+	b.WriteString(" b=")
+	for len(sig) > 72 {
+		b.WriteString(sig[:72])
+		b.WriteString(crlf + " ")
+		sig = sig[72:]
+	}
+	b.WriteString(sig)
+	b.WriteString(crlf)
+	return b.String()
+}
+
+// SignFields signs the header fields of h selected by keys together with
+// the signature header field made up of name and tags, and returns that
+// header field including its b= tag.
+func SignFields(h Header, name string, tags []Tag, keys []string, can string, signer crypto.Signer, hash crypto.Hash) (string, error) {
+	data := HeaderHashInput(h, keys, FormatField(name, tags, ""), can)
+	sig, err := SignData(signer, hash, data)
+	if err != nil {
+		return "", err
+	}
+	return FormatField(name, tags, base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// Sign creates a DKIM-Signature header field for m.
+func Sign(m *Message, options *SignOptions, now time.Time) (string, error) {
+	keyAlgo, err := KeyAlgo(options.Signer.Public())
+	if err != nil {
+		return "", err
+	}
+	if options.Hash != crypto.SHA256 {
+		return "", fmt.Errorf("unsupported hash algorithm")
+	}
+	headerCan := options.HeaderCanonicalization
+	if headerCan == "" {
+		headerCan = CanonicalizationSimple
+	}
+	bodyCan := options.BodyCanonicalization
+	if bodyCan == "" {
+		bodyCan = CanonicalizationSimple
+	}
+	if !ValidCanonicalization(headerCan) || !ValidCanonicalization(bodyCan) {
+		return "", fmt.Errorf("unknown canonicalization %s/%s", headerCan, bodyCan)
+	}
+	if !ContainsValue(options.HeaderKeys, "From") {
+		return "", fmt.Errorf("the From header field must be signed")
+	}
+
+	bodyHash, bodyLength := BodyHash(m.Body, bodyCan, options.Hash, -1)
+	tags := []Tag{
+		{"v", "1"},
+		{"a", keyAlgo + "-sha256"},
+		{"c", headerCan + "/" + bodyCan},
+		{"d", options.Domain},
+		{"s", options.Selector},
+	}
+	if options.Identifier != "" {
+		tags = append(tags, Tag{"i", options.Identifier})
+	}
+	tags = append(tags, Tag{"t", strconv.FormatInt(now.Unix(), 10)})
+	if !options.Expiration.IsZero() {
+		tags = append(tags, Tag{"x", strconv.FormatInt(options.Expiration.Unix(), 10)})
+	}
+	if options.BodyLength {
+		tags = append(tags, Tag{"l", strconv.FormatInt(bodyLength, 10)})
+	}
+	tags = append(tags,
+		Tag{"h", strings.Join(options.HeaderKeys, ":")},
+		Tag{"bh", base64.StdEncoding.EncodeToString(bodyHash)},
+	)
+
+	return SignFields(m.Header, SignatureFieldName, tags, options.HeaderKeys, headerCan, options.Signer, options.Hash)
+}
@@ -0,0 +1,238 @@
+package dkimutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// crossCheckMessage exercises the canonicalization algorithms with folded
+// and oddly spaced header fields and trailing whitespace and empty lines.
+const crossCheckMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To:   Suzie Q <suzie@shopping.example.net>\r\n" +
+	"subject:Is dinner ready?  \r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"X-Folded: first line\r\n" +
+	" \t second line \r\n" +
+	"\r\n" +
+	"Hi.  \r\n" +
+	"\r\n" +
+	"We lost the game. \t Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n" +
+	"\r\n" +
+	"\r\n"
+
+var crossCheckHeaderKeys = []string{"From", "To", "Subject", "Date", "Message-ID", "X-Folded"}
+
+var crossCheckCanonicalizations = []string{CanonicalizationSimple, CanonicalizationRelaxed}
+
+type crossCheckKey struct {
+	name   string
+	signer crypto.Signer
+	record string
+}
+
+func crossCheckKeys(t *testing.T) []crossCheckKey {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaDER, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []crossCheckKey{
+		{"rsa", rsaKey, "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaDER)},
+		{"ed25519", edKey, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))},
+	}
+}
+
+func lookupRecord(record string) func(domain string) ([]string, error) {
+	return func(domain string) ([]string, error) {
+		if domain != "test._domainkey.example.com" {
+			return nil, fmt.Errorf("no key for %s", domain)
+		}
+		return []string{record}, nil
+	}
+}
+
+// TestSignVerifiedByMsgAuth checks that go-msgauth verifies the signatures
+// created by Sign.
+func TestSignVerifiedByMsgAuth(t *testing.T) {
+	for _, key := range crossCheckKeys(t) {
+		for _, headerCan := range crossCheckCanonicalizations {
+			for _, bodyCan := range crossCheckCanonicalizations {
+				t.Run(key.name+"/"+headerCan+"/"+bodyCan, func(t *testing.T) {
+					m, err := ParseMessage([]byte(crossCheckMessage))
+					if err != nil {
+						t.Fatal(err)
+					}
+					sig, err := Sign(m, &SignOptions{
+						Domain:                 "example.com",
+						Selector:               "test",
+						Signer:                 key.signer,
+						Hash:                   crypto.SHA256,
+						HeaderCanonicalization: headerCan,
+						BodyCanonicalization:   bodyCan,
+						HeaderKeys:             crossCheckHeaderKeys,
+					}, time.Now())
+					if err != nil {
+						t.Fatalf("Sign() failed: %s", err)
+					}
+
+					verifs, err := dkim.VerifyWithOptions(strings.NewReader(sig+crossCheckMessage), &dkim.VerifyOptions{
+						LookupTXT: lookupRecord(key.record),
+					})
+					if err != nil {
+						t.Fatalf("dkim.Verify() failed: %s", err)
+					}
+					if len(verifs) != 1 || verifs[0].Err != nil {
+						t.Fatalf("dkim.Verify() = %+v, want one valid signature", verifs)
+					}
+
+					tampered := strings.Replace(crossCheckMessage, "hungry", "thirsty", 1)
+					verifs, err = dkim.VerifyWithOptions(strings.NewReader(sig+tampered), &dkim.VerifyOptions{
+						LookupTXT: lookupRecord(key.record),
+					})
+					if err != nil || len(verifs) != 1 || verifs[0].Err == nil {
+						t.Errorf("dkim.Verify() of a tampered message did not fail")
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestVerifyMsgAuthSignature checks that Verify accepts the signatures
+// created by go-msgauth.
+func TestVerifyMsgAuthSignature(t *testing.T) {
+	for _, key := range crossCheckKeys(t) {
+		for _, headerCan := range crossCheckCanonicalizations {
+			for _, bodyCan := range crossCheckCanonicalizations {
+				t.Run(key.name+"/"+headerCan+"/"+bodyCan, func(t *testing.T) {
+					var signed bytes.Buffer
+					err := dkim.Sign(&signed, strings.NewReader(crossCheckMessage), &dkim.SignOptions{
+						Domain:                 "example.com",
+						Selector:               "test",
+						Signer:                 key.signer,
+						Hash:                   crypto.SHA256,
+						HeaderCanonicalization: dkim.Canonicalization(headerCan),
+						BodyCanonicalization:   dkim.Canonicalization(bodyCan),
+						HeaderKeys:             crossCheckHeaderKeys,
+					})
+					if err != nil {
+						t.Fatalf("dkim.Sign() failed: %s", err)
+					}
+
+					m, err := ParseMessage(signed.Bytes())
+					if err != nil {
+						t.Fatal(err)
+					}
+					fields := m.Header.SignatureFields(SignatureFieldName)
+					if len(fields) != 1 {
+						t.Fatalf("found %d signatures, want 1", len(fields))
+					}
+					res := Verify(m, fields[0], lookupRecord(key.record))
+					if res.Err != nil {
+						t.Fatalf("Verify() failed: %s", res.Err)
+					}
+					if !bytes.Equal(res.BodyHash, res.ComputedBodyHash) {
+						t.Errorf("Verify() computed body hash %x, want %x", res.ComputedBodyHash, res.BodyHash)
+					}
+
+					m.Body = bytes.Replace(m.Body, []byte("hungry"), []byte("thirsty"), 1)
+					if res := Verify(m, fields[0], lookupRecord(key.record)); res.Err == nil {
+						t.Errorf("Verify() of a tampered message did not fail")
+					}
+				})
+			}
+		}
+	}
+}
+
+// oversignedHeaderKeys lists From and Subject once more than they occur and
+// the missing Reply-To, so that adding these header fields breaks signatures.
+var oversignedHeaderKeys = append(append([]string(nil), crossCheckHeaderKeys...), "From", "Subject", "Reply-To")
+
+// TestSignBodyLengthOversigned checks that signatures with the body length
+// tag and oversigned header fields survive appended content, but not added
+// header fields. go-msgauth rejects the l= tag, so it only verifies the
+// signatures without it.
+func TestSignBodyLengthOversigned(t *testing.T) {
+	for _, key := range crossCheckKeys(t) {
+		for _, bodyLength := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/l=%t", key.name, bodyLength), func(t *testing.T) {
+				m, err := ParseMessage([]byte(crossCheckMessage))
+				if err != nil {
+					t.Fatal(err)
+				}
+				sig, err := Sign(m, &SignOptions{
+					Domain:                 "example.com",
+					Selector:               "test",
+					Signer:                 key.signer,
+					Hash:                   crypto.SHA256,
+					HeaderCanonicalization: CanonicalizationRelaxed,
+					BodyCanonicalization:   CanonicalizationSimple,
+					HeaderKeys:             oversignedHeaderKeys,
+					BodyLength:             bodyLength,
+				}, time.Now())
+				if err != nil {
+					t.Fatalf("Sign() failed: %s", err)
+				}
+				if hasLength := strings.Contains(sig, " l="); hasLength != bodyLength {
+					t.Fatalf("Sign() added l= tag %t, want %t", hasLength, bodyLength)
+				}
+
+				verify := func(msg string) error {
+					m, err := ParseMessage([]byte(sig + msg))
+					if err != nil {
+						t.Fatal(err)
+					}
+					fields := m.Header.SignatureFields(SignatureFieldName)
+					if len(fields) != 1 {
+						t.Fatalf("found %d signatures, want 1", len(fields))
+					}
+					return Verify(m, fields[0], lookupRecord(key.record)).Err
+				}
+				if err := verify(crossCheckMessage); err != nil {
+					t.Errorf("Verify() failed: %s", err)
+				}
+				if !bodyLength {
+					verifs, err := dkim.VerifyWithOptions(strings.NewReader(sig+crossCheckMessage), &dkim.VerifyOptions{
+						LookupTXT: lookupRecord(key.record),
+					})
+					if err != nil || len(verifs) != 1 || verifs[0].Err != nil {
+						t.Errorf("dkim.Verify() = %+v, %v, want one valid signature", verifs, err)
+					}
+				}
+
+				appended := crossCheckMessage + "-- \r\nappended by a mailing list\r\n"
+				if err := verify(appended); (err == nil) != bodyLength {
+					t.Errorf("Verify() with appended content = %v, want success %t", err, bodyLength)
+				}
+				for _, field := range []string{"From: Mallory <mallory@example.net>\r\n", "Subject: Urgent\r\n", "Reply-To: mallory@example.net\r\n"} {
+					if err := verify(field + crossCheckMessage); err == nil {
+						t.Errorf("Verify() with an added %q did not fail", field)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package dkimutil
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SignatureFieldName is the name of the DKIM signature header field.
+const SignatureFieldName = "DKIM-Signature"
+
+// Result is the detailed outcome of verifying one signature header field.
+type Result struct {
+	Field      string
+	Tags       map[string]string
+	Domain     string
+	Selector   string
+	Identifier string
+	// Instance is the i= tag of an ARC-Message-Signature header field.
+	Instance   int
+	KeyAlgo    string
+	HashAlgo   string
+	HeaderCan  string
+	BodyCan    string
+	HeaderKeys []string
+
+	// BodyLength is the value of the l= tag or -1 if it is not present.
+	BodyLength int64
+	// CanonicalBodyLength is the length of the whole canonicalized body.
+	CanonicalBodyLength int64
+
+	BodyHash         []byte
+	ComputedBodyHash []byte
+	HeaderHashInput  []byte
+	HeaderHash       []byte
+
+	// Key is the key record that was used, nil if the lookup failed.
+	Key *KeyRecord
+
+	// BodyHashErr and SignatureErr are set if the respective check failed,
+	// Err is the first error that prevented successful verification.
+	BodyHashErr  error
+	SignatureErr error
+	Err          error
+}
+
+// SignatureFields returns all header fields with the given name, for
+// example SignatureFieldName, in message order.
+func (h Header) SignatureFields(name string) []string {
+	var fields []string
+	for _, kv := range h {
+		k, _ := ParseField(kv)
+		if strings.EqualFold(k, name) {
+			fields = append(fields, kv)
+		}
+	}
+	return fields
+}
+
+func hashByName(name string) (crypto.Hash, error) {
+	switch name {
+	case "sha256":
+		return crypto.SHA256, nil
+	case "sha1":
+		// RFC 8301 section 3.1: rsa-sha1 MUST NOT be used for signing or
+		// verifying.
+		return 0, fmt.Errorf("hash algorithm too weak: %s", name)
+	default:
+		return 0, fmt.Errorf("unsupported hash algorithm %s", name)
+	}
+}
+
+// Verify checks the signature header field of m, which must be one of its
+// header fields, and records every intermediate step in the result.
+// The field may also be an ARC-Message-Signature, whose i= tag is the
+// instance instead of the identity. The public key is retrieved using lookupTXT.
+func Verify(m *Message, field string, lookupTXT func(domain string) ([]string, error)) *Result {
+	res := &Result{Field: field, BodyLength: -1}
+	res.Err = verify(m, res, lookupTXT)
+	return res
+}
+
+func verify(m *Message, res *Result, lookupTXT func(domain string) ([]string, error)) error {
+	name, value := ParseField(res.Field)
+	tags, err := ParseTags(value)
+	if err != nil {
+		return fmt.Errorf("malformed signature tags: %s", err)
+	}
+	res.Tags = tags
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if _, found := tags[tag]; !found {
+			return fmt.Errorf("signature missing required tag %s=", tag)
+		}
+	}
+
+	res.Domain = StripWhitespace(tags["d"])
+	res.Selector = StripWhitespace(tags["s"])
+	res.Identifier = "@" + res.Domain
+	if strings.EqualFold(name, ARCMessageSignatureFieldName) {
+		res.Instance, err = parseInstance(tags["i"])
+		if err != nil {
+			return err
+		}
+	} else if i, found := tags["i"]; found {
+		res.Identifier = StripWhitespace(i)
+		if !strings.HasSuffix(res.Identifier, "@"+res.Domain) &&
+			!strings.HasSuffix(res.Identifier, "."+res.Domain) {
+			return fmt.Errorf("identity i=%s is not within domain d=%s", res.Identifier, res.Domain)
+		}
+	}
+	res.HeaderKeys = ParseTagList(tags["h"])
+	if !ContainsValue(res.HeaderKeys, "From") {
+		return fmt.Errorf("From field not signed")
+	}
+	res.HeaderCan, res.BodyCan = ParseCanonicalization(tags["c"])
+	if !ValidCanonicalization(res.HeaderCan) || !ValidCanonicalization(res.BodyCan) {
+		return fmt.Errorf("unsupported canonicalization c=%s", tags["c"])
+	}
+
+	algos := strings.SplitN(StripWhitespace(tags["a"]), "-", 2)
+	if len(algos) != 2 {
+		return fmt.Errorf("malformed algorithm a=%s", tags["a"])
+	}
+	res.KeyAlgo, res.HashAlgo = algos[0], algos[1]
+	hash, err := hashByName(res.HashAlgo)
+	if err != nil {
+		return err
+	}
+
+	if l, found := tags["l"]; found {
+		res.BodyLength, err = strconv.ParseInt(StripWhitespace(l), 10, 64)
+		if err != nil || res.BodyLength < 0 {
+			return fmt.Errorf("malformed body length l=%s", l)
+		}
+	}
+	res.BodyHash, err = base64.StdEncoding.DecodeString(StripWhitespace(tags["bh"]))
+	if err != nil {
+		return fmt.Errorf("malformed body hash: %s", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(StripWhitespace(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("malformed signature: %s", err)
+	}
+
+	res.ComputedBodyHash, res.CanonicalBodyLength = BodyHash(m.Body, res.BodyCan, hash, res.BodyLength)
+	if res.BodyLength > res.CanonicalBodyLength {
+		res.BodyHashErr = fmt.Errorf("body length l=%d exceeds canonical body length %d", res.BodyLength, res.CanonicalBodyLength)
+	} else if !bytes.Equal(res.BodyHash, res.ComputedBodyHash) {
+		res.BodyHashErr = fmt.Errorf("body hash did not verify")
+	}
+
+	res.HeaderHashInput = HeaderHashInput(m.Header, res.HeaderKeys, RemoveSignatureValue(res.Field), res.HeaderCan)
+	hasher := hash.New()
+	hasher.Write(res.HeaderHashInput)
+	res.HeaderHash = hasher.Sum(nil)
+
+	res.Key, err = lookupKey(res.Domain, res.Selector, res.KeyAlgo, res.HashAlgo, lookupTXT)
+	if err != nil {
+		return err
+	}
+
+	if err := VerifySignature(res.Key.PublicKey, hash, res.HeaderHash, sig); err != nil {
+		res.SignatureErr = fmt.Errorf("signature did not verify: %s", err)
+	}
+
+	if res.BodyHashErr != nil {
+		return res.BodyHashErr
+	}
+	return res.SignatureErr
+}
+
+func lookupKey(domain, selector, keyAlgo, hashAlgo string, lookupTXT func(domain string) ([]string, error)) (*KeyRecord, error) {
+	txts, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, fmt.Errorf("key unavailable: %s", err)
+	}
+	key, err := ParseKeyRecord(strings.Join(txts, ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key record: %s", err)
+	}
+	if key.KeyAlgo != keyAlgo {
+		return key, fmt.Errorf("key algorithm k=%s does not match a=%s-%s", key.KeyAlgo, keyAlgo, hashAlgo)
+	}
+	if key.HashAlgos != nil && !ContainsValue(key.HashAlgos, hashAlgo) {
+		return key, fmt.Errorf("hash algorithm %s not allowed by key record", hashAlgo)
+	}
+	return key, nil
+}
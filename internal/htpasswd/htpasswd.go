@@ -0,0 +1,151 @@
+package htpasswd
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrMismatch is returned if the username is unknown or the password is wrong.
+var ErrMismatch = errors.New("htpasswd: username or password mismatch")
+
+// dummyHash is compared against for unknown users, so that they cannot be
+// distinguished by the response time.
+var dummyHash = []byte("$2a$10$oAqeJHjWbBJOlzDE/YZz.e1EyYaMXXsmxA6fi2klV3YAWZeRkhUke")
+
+// File is a htpasswd-style file of "username:hash" lines with bcrypt
+// ($2a$, $2b$, $2y$) or Argon2 ($argon2i$, $argon2id$) password hashes.
+// It is reloaded on SIGHUP.
+type File struct {
+	usersMu sync.RWMutex
+	users   map[string]string
+	path    string
+}
+
+// NewFile loads the htpasswd file at path.
+func NewFile(path string) (*File, error) {
+	result := &File{path: path}
+	if err := result.maybeReload(); err != nil {
+		return nil, err
+	}
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			log.Printf("Received SIGHUP, reloading users from %q", path)
+			if err := result.maybeReload(); err != nil {
+				log.Printf("Keeping old users because the new ones could not be loaded: %v", err)
+			}
+		}
+	}()
+	return result, nil
+}
+
+func parse(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("malformed line %d", lineno)
+		}
+		if !strings.HasPrefix(kv[1], "$2") && !strings.HasPrefix(kv[1], "$argon2") {
+			return nil, fmt.Errorf("unsupported hash for user %q on line %d", kv[0], lineno)
+		}
+		users[kv[0]] = kv[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (f *File) maybeReload() error {
+	users, err := parse(f.path)
+	if err != nil {
+		return err
+	}
+	f.usersMu.Lock()
+	defer f.usersMu.Unlock()
+	f.users = users
+	return nil
+}
+
+// Authenticate checks the password of username.
+func (f *File) Authenticate(username, password string) error {
+	f.usersMu.RLock()
+	hash, found := f.users[username]
+	f.usersMu.RUnlock()
+	if !found {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return ErrMismatch
+	}
+	if strings.HasPrefix(hash, "$argon2") {
+		return compareArgon2(hash, password)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// compareArgon2 compares password with a hash in the PHC string format,
+// e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+func compareArgon2(hash, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return fmt.Errorf("htpasswd: malformed argon2 hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return fmt.Errorf("htpasswd: unsupported argon2 version %s", parts[2])
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time < 1 || threads < 1 {
+		return fmt.Errorf("htpasswd: malformed argon2 parameters %s", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("htpasswd: malformed argon2 salt: %s", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return fmt.Errorf("htpasswd: malformed argon2 hash: %s", err)
+	}
+
+	var computed []byte
+	switch parts[1] {
+	case "argon2id":
+		computed = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	case "argon2i":
+		computed = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	default:
+		return fmt.Errorf("htpasswd: unsupported algorithm %s", parts[1])
+	}
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
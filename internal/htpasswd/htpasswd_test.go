@@ -0,0 +1,84 @@
+package htpasswd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Known-answer vectors from the OpenBSD bcrypt tests and from the test
+// suite of the Argon2 reference implementation (phc-winner-argon2).
+var hashVectors = []struct {
+	name     string
+	hash     string
+	password string
+}{
+	{"bcrypt-2a", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"bcrypt-2a-longer", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK", "U*U*"},
+	{"bcrypt-2a-empty", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy", ""},
+	{"bcrypt-2a-72", "$2a$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui",
+		"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789chars after 72 are ignored"},
+	{"bcrypt-2y", "$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"argon2i", "$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$wWKIMhR9lyDFvRz9YTZweHKfbftvj+qf+YFY4NeBbtA", "password"},
+	{"argon2id", "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", "password"},
+}
+
+func writeFile(t *testing.T, content string) *File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("NewFile() failed: %s", err)
+	}
+	return f
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, vector := range hashVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			f := writeFile(t, "user@example.com:"+vector.hash+"\n")
+			if err := f.Authenticate("user@example.com", vector.password); err != nil {
+				t.Errorf("Authenticate() with the correct password failed: %s", err)
+			}
+			if err := f.Authenticate("user@example.com", "x"+vector.password); err != ErrMismatch {
+				t.Errorf("Authenticate() with a wrong password = %v, want %v", err, ErrMismatch)
+			}
+			if err := f.Authenticate("other@example.com", vector.password); err != ErrMismatch {
+				t.Errorf("Authenticate() of an unknown user = %v, want %v", err, ErrMismatch)
+			}
+		})
+	}
+}
+
+func TestAuthenticateMalformedArgon2(t *testing.T) {
+	for _, hash := range []string{
+		"$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2d$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ",
+	} {
+		f := writeFile(t, "user@example.com:"+hash+"\n")
+		if err := f.Authenticate("user@example.com", "password"); err == nil {
+			t.Errorf("Authenticate() succeeded for %s", hash)
+		}
+	}
+}
+
+func TestNewFileMalformed(t *testing.T) {
+	for _, content := range []string{
+		"user@example.com\n",
+		":$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW\n",
+		"user@example.com:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n",
+	} {
+		path := filepath.Join(t.TempDir(), "users")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewFile(path); err == nil {
+			t.Errorf("NewFile() succeeded for %q", content)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package saslutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// XOAuth2 is the name of the XOAUTH2 mechanism, which predates and is
+// similar to OAUTHBEARER (RFC 7628).
+const XOAuth2 = "XOAUTH2"
+
+// ErrUnexpectedChallenge is returned by the client if the server sends
+// more than one error challenge.
+var ErrUnexpectedChallenge = errors.New("saslutil: unexpected XOAUTH2 challenge")
+
+type xoauth2Client struct {
+	username string
+	token    string
+	failed   bool
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return XOAuth2, ir, nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server sends a JSON error description as challenge, which is
+	// answered with an empty response to receive the final error reply.
+	if a.failed {
+		return nil, ErrUnexpectedChallenge
+	}
+	a.failed = true
+	return []byte{}, nil
+}
+
+// NewXOAuth2Client creates a client for the XOAUTH2 mechanism.
+func NewXOAuth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+// XOAuth2Authenticator authenticates username with the bearer token.
+type XOAuth2Authenticator func(username, token string) error
+
+type xoauth2Server struct {
+	done         bool
+	authenticate XOAuth2Authenticator
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.done {
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+
+	// No initial response, send an empty challenge
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	a.done = true
+
+	var username, token string
+	for _, param := range bytes.Split(response, []byte{0x01}) {
+		if len(param) == 0 {
+			continue
+		}
+		kv := strings.SplitN(string(param), "=", 2)
+		if len(kv) != 2 {
+			return nil, false, fmt.Errorf("Invalid response, missing '='")
+		}
+		switch kv[0] {
+		case "user":
+			username = kv[1]
+		case "auth":
+			const prefix = "bearer "
+			if !strings.HasPrefix(strings.ToLower(kv[1]), prefix) {
+				return nil, false, errors.New("Unsupported token type")
+			}
+			token = kv[1][len(prefix):]
+		}
+	}
+	if username == "" || token == "" {
+		return nil, false, errors.New("Invalid response, missing user or token")
+	}
+
+	return nil, true, a.authenticate(username, token)
+}
+
+// NewXOAuth2Server creates a server for the XOAUTH2 mechanism.
+func NewXOAuth2Server(authenticator XOAuth2Authenticator) sasl.Server {
+	return &xoauth2Server{authenticate: authenticator}
+}
@@ -3,9 +3,15 @@ package smtpproxy
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-smtp"
+	log "github.com/sirupsen/logrus"
 )
 
 type Security int
@@ -16,94 +22,300 @@ const (
 	SecurityNone
 )
 
+// Default time a failed server is skipped for, which doubles with every
+// consecutive failure up to the maximum.
+const (
+	DefaultMinBackoff = 10 * time.Second
+	DefaultMaxBackoff = 5 * time.Minute
+)
+
+// DefaultDialTimeout is used if DialTimeout is not set.
+const DefaultDialTimeout = 30 * time.Second
+
 type Backend struct {
-	Addr      string
+	// Addrs are the upstream servers in order of preference.
+	Addrs     []string
 	Security  Security
 	TLSConfig *tls.Config
-	LMTP      bool
-	Host      string
+	// LMTP servers are connected to by unix socket and do not
+	// authenticate, so NewPooledSession skips AUTH.
+	LMTP bool
+	Host string
+	// LocalName is sent with EHLO or LHLO, "localhost" if empty.
 	LocalName string
 
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// DialTimeout limits connecting to a server including the TLS
+	// handshake, greeting, EHLO and STARTTLS, DefaultDialTimeout if zero.
+	DialTimeout time.Duration
+
+	// Balance selects how sessions are distributed among the servers,
+	// using Weights which default to 1 for every server.
+	Balance Balance
+	Weights []int
+
+	// MaxConnsPerHost limits the open connections to each server,
+	// including idle pooled ones, if it is positive.
+	MaxConnsPerHost int
+	// MaxIdlePerHost is the number of authenticated connections per
+	// server kept for reuse by NewPooledSession for up to IdleTimeout.
+	MaxIdlePerHost int
+	IdleTimeout    time.Duration
+
+	downMu sync.Mutex
+	down   map[string]*downState
+
+	balanceMu sync.Mutex
+	current   map[string]int
+	inflight  map[string]int
+	idling    map[string]int
+
+	idleMu sync.Mutex
+	idle   []*idleConn
+
 	unexported struct{}
 }
 
-func New(addr string) *Backend {
-	return &Backend{Addr: addr, Security: SecurityStartTLS}
+type downState struct {
+	failures int
+	until    time.Time
 }
 
-func NewTLS(addr string, tlsConfig *tls.Config) *Backend {
+func New(addrs []string) *Backend {
+	return &Backend{Addrs: addrs, Security: SecurityStartTLS}
+}
+
+func NewTLS(addrs []string, tlsConfig *tls.Config) *Backend {
 	return &Backend{
-		Addr:      addr,
+		Addrs:     addrs,
 		Security:  SecurityTLS,
 		TLSConfig: tlsConfig,
 	}
 }
 
-func NewLMTP(addr string, host string) *Backend {
+func NewLMTP(addrs []string, host string) *Backend {
 	return &Backend{
-		Addr:     addr,
+		Addrs:    addrs,
 		Security: SecurityNone,
 		LMTP:     true,
 		Host:     host,
 	}
 }
 
-func (be *Backend) newConn() (*smtp.Client, error) {
-	var conn net.Conn
-	var err error
-	if be.LMTP {
-		if be.Security != SecurityNone {
-			return nil, errors.New("smtp-proxy: LMTP doesn't support TLS")
+// candidates returns the servers to try in order: first all servers which
+// are not marked down as ordered by Balance, then the down ones by the end
+// of their backoff, so that a connection is still attempted if every server
+// is marked down.
+func (be *Backend) candidates(now time.Time) []string {
+	be.downMu.Lock()
+	defer be.downMu.Unlock()
+
+	var up, down []string
+	for _, addr := range be.Addrs {
+		if state, found := be.down[addr]; found && now.Before(state.until) {
+			down = append(down, addr)
+		} else {
+			up = append(up, addr)
 		}
-		conn, err = net.Dial("unix", be.Addr)
-	} else if be.Security == SecurityTLS {
-		conn, err = tls.Dial("tcp", be.Addr, be.TLSConfig)
-	} else {
-		conn, err = net.Dial("tcp", be.Addr)
 	}
+	sort.SliceStable(down, func(i, j int) bool {
+		return be.down[down[i]].until.Before(be.down[down[j]].until)
+	})
+	return append(be.balance(up), down...)
+}
+
+func (be *Backend) markDown(addr string, now time.Time, err error) {
+	be.downMu.Lock()
+	defer be.downMu.Unlock()
+
+	if be.down == nil {
+		be.down = make(map[string]*downState)
+	}
+	state, found := be.down[addr]
+	if !found {
+		state = &downState{}
+		be.down[addr] = state
+	}
+	state.failures++
+
+	backoff, max := be.MinBackoff, be.MaxBackoff
+	if backoff <= 0 {
+		backoff = DefaultMinBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	for i := 1; i < state.failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	state.until = now.Add(backoff)
+	log.Warnf("Upstream server %s marked down for %s after %d failure(s): %s", addr, backoff, state.failures, err)
+}
+
+func (be *Backend) markUp(addr string) {
+	be.downMu.Lock()
+	defer be.downMu.Unlock()
+
+	if _, found := be.down[addr]; found {
+		log.Infof("Upstream server %s is up again", addr)
+		delete(be.down, addr)
+	}
+}
+
+// newConn connects to the first server that accepts the connection,
+// marking the ones that fail to connect, negotiate TLS or greet as down.
+func (be *Backend) newConn() (*smtp.Client, string, error) {
+	if len(be.Addrs) == 0 {
+		return nil, "", errors.New("smtp-proxy: no upstream server configured")
+	}
+	return be.connect(be.candidates(time.Now()))
+}
+
+// connect connects to the first server of addrs that accepts the connection.
+func (be *Backend) connect(addrs []string) (*smtp.Client, string, error) {
+	var errs []string
+	for _, addr := range addrs {
+		inflight, ok := be.acquire(addr)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: too many connections", addr))
+			continue
+		}
+		c, err := be.dial(addr)
+		if err != nil {
+			be.release(addr)
+			be.markDown(addr, time.Now(), err)
+			errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+			continue
+		}
+		be.markUp(addr)
+		log.Infof("Opened connection to upstream server %s (%d in flight)", addr, inflight)
+		return c, addr, nil
+	}
+	return nil, "", fmt.Errorf("smtp-proxy: no upstream server available: %s", strings.Join(errs, "; "))
+}
+
+// deadlineConn limits every deadline set on the connection to limit, so
+// that the deadlines set by smtp.Client cannot extend the setup timeout.
+type deadlineConn struct {
+	net.Conn
+	limit time.Time
+}
+
+func (dc *deadlineConn) clamp(t time.Time) time.Time {
+	if !dc.limit.IsZero() && (t.IsZero() || t.After(dc.limit)) {
+		return dc.limit
+	}
+	return t
+}
+
+func (dc *deadlineConn) SetDeadline(t time.Time) error {
+	return dc.Conn.SetDeadline(dc.clamp(t))
+}
+
+func (dc *deadlineConn) SetReadDeadline(t time.Time) error {
+	return dc.Conn.SetReadDeadline(dc.clamp(t))
+}
+
+func (dc *deadlineConn) SetWriteDeadline(t time.Time) error {
+	return dc.Conn.SetWriteDeadline(dc.clamp(t))
+}
+
+func (be *Backend) dialTimeout() time.Duration {
+	if be.DialTimeout > 0 {
+		return be.DialTimeout
+	}
+	return DefaultDialTimeout
+}
+
+// dial connects to addr within DialTimeout, which covers the TLS handshake,
+// the greeting, EHLO and STARTTLS.
+func (be *Backend) dial(addr string) (*smtp.Client, error) {
+	if be.LMTP && be.Security != SecurityNone {
+		return nil, errors.New("smtp-proxy: LMTP doesn't support TLS")
+	}
+	timeout := be.dialTimeout()
+	dialer := &net.Dialer{Timeout: timeout}
+	network := "tcp"
+	if be.LMTP {
+		network = "unix"
+	}
+	raw, err := dialer.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
+	dc := &deadlineConn{Conn: raw, limit: time.Now().Add(timeout)}
+	dc.SetDeadline(time.Time{})
+
+	host := be.Host
+	if host == "" {
+		host, _, _ = net.SplitHostPort(addr)
+	}
+
+	var conn net.Conn = dc
+	if be.Security == SecurityTLS {
+		tlsConfig := be.TLSConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		tlsConn := tls.Client(dc, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
 
 	var c *smtp.Client
 	if be.LMTP {
-		c, err = smtp.NewClientLMTP(conn, be.Host)
+		c, err = smtp.NewClientLMTP(conn, host)
 	} else {
-		host := be.Host
-		if host == "" {
-			host, _, _ = net.SplitHostPort(be.Addr)
-		}
 		c, err = smtp.NewClient(conn, host)
 	}
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	if be.LocalName != "" {
-		err = c.Hello(be.LocalName)
-		if err != nil {
-			return nil, err
-		}
+	// Send EHLO now instead of with the first command after the setup.
+	localName := be.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+	if err := c.Hello(localName); err != nil {
+		c.Close()
+		return nil, err
 	}
 
 	if be.Security == SecurityStartTLS {
 		if err := c.StartTLS(be.TLSConfig); err != nil {
+			c.Close()
 			return nil, err
 		}
 	}
 
+	dc.limit = time.Time{}
+	dc.SetDeadline(time.Time{})
 	return c, nil
 }
 
 func (be *Backend) NewSession(*smtp.Conn) (smtp.Session, error) {
-	c, err := be.newConn()
+	c, addr, err := be.newConn()
 	if err != nil {
 		return nil, err
 	}
 
 	s := &session{
-		c:  c,
-		be: be,
+		c:    c,
+		be:   be,
+		addr: addr,
 	}
 	return s, nil
 }
@@ -0,0 +1,127 @@
+package smtpproxy
+
+import (
+	"sort"
+
+	"github.com/emersion/go-smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+type Balance int
+
+const (
+	// BalanceFailover always prefers the servers in the order of Addrs.
+	BalanceFailover Balance = iota
+	// BalanceRoundRobin distributes sessions in proportion to Weights
+	// using smooth weighted round-robin.
+	BalanceRoundRobin
+	// BalanceLeastConn prefers the server with the fewest sessions in
+	// flight relative to its weight, not counting idle pooled connections.
+	BalanceLeastConn
+)
+
+func (be *Backend) weight(addr string) int {
+	for idx, a := range be.Addrs {
+		if a == addr && idx < len(be.Weights) && be.Weights[idx] > 0 {
+			return be.Weights[idx]
+		}
+	}
+	return 1
+}
+
+// balance orders the available servers up, which are in the order of
+// Addrs, by preference. The remaining servers are kept as failover.
+func (be *Backend) balance(up []string) []string {
+	if len(up) < 2 {
+		return up
+	}
+
+	be.balanceMu.Lock()
+	defer be.balanceMu.Unlock()
+
+	switch be.Balance {
+	case BalanceRoundRobin:
+		if be.current == nil {
+			be.current = make(map[string]int)
+		}
+		best, total := 0, 0
+		for idx, addr := range up {
+			weight := be.weight(addr)
+			be.current[addr] += weight
+			total += weight
+			if be.current[addr] > be.current[up[best]] {
+				best = idx
+			}
+		}
+		be.current[up[best]] -= total
+
+		ordered := append([]string{up[best]}, up[:best]...)
+		return append(ordered, up[best+1:]...)
+	case BalanceLeastConn:
+		ordered := append([]string(nil), up...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			// Compare inflight[i]/weight[i] < inflight[j]/weight[j]
+			// without the rounding of integer division.
+			return be.busy(ordered[i])*be.weight(ordered[j]) <
+				be.busy(ordered[j])*be.weight(ordered[i])
+		})
+		return ordered
+	default:
+		return up
+	}
+}
+
+// busy returns the number of connections to addr used by a session.
+// balanceMu must be held.
+func (be *Backend) busy(addr string) int {
+	return be.inflight[addr] - be.idling[addr]
+}
+
+// setIdle counts a connection to addr as idle or, with a negative delta,
+// as used again.
+func (be *Backend) setIdle(addr string, delta int) {
+	be.balanceMu.Lock()
+	defer be.balanceMu.Unlock()
+
+	if be.idling == nil {
+		be.idling = make(map[string]int)
+	}
+	be.idling[addr] += delta
+}
+
+// acquire counts a connection to addr unless MaxConnsPerHost connections
+// are already open and returns the number of open connections.
+func (be *Backend) acquire(addr string) (int, bool) {
+	be.balanceMu.Lock()
+	defer be.balanceMu.Unlock()
+
+	if be.MaxConnsPerHost > 0 && be.inflight[addr] >= be.MaxConnsPerHost {
+		return be.inflight[addr], false
+	}
+	if be.inflight == nil {
+		be.inflight = make(map[string]int)
+	}
+	be.inflight[addr]++
+	return be.inflight[addr], true
+}
+
+// release uncounts a connection to addr and returns the number of open
+// connections.
+func (be *Backend) release(addr string) int {
+	be.balanceMu.Lock()
+	defer be.balanceMu.Unlock()
+
+	if be.inflight[addr] > 0 {
+		be.inflight[addr]--
+	}
+	return be.inflight[addr]
+}
+
+func (be *Backend) closeConn(c *smtp.Client, addr string) error {
+	err := c.Quit()
+	if err != nil {
+		c.Close()
+	}
+	log.Infof("Closed connection to upstream server %s (%d in flight)", addr, be.release(addr))
+	return err
+}
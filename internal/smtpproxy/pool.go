@@ -0,0 +1,144 @@
+package smtpproxy
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultIdleTimeout is used if IdleTimeout is not set.
+const DefaultIdleTimeout = 30 * time.Second
+
+// probeTimeout limits the NOOP and RSET commands checking pooled connections.
+const probeTimeout = 10 * time.Second
+
+type idleConn struct {
+	c     *smtp.Client
+	addr  string
+	timer *time.Timer
+}
+
+func (be *Backend) idleTimeout() time.Duration {
+	if be.IdleTimeout > 0 {
+		return be.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// probe runs cmd on c with a short command timeout.
+func probe(c *smtp.Client, cmd func() error) error {
+	timeout := c.CommandTimeout
+	c.CommandTimeout = probeTimeout
+	defer func() { c.CommandTimeout = timeout }()
+	return cmd()
+}
+
+// NewPooledSession returns a session on an idle connection, which already
+// authenticated with the same credentials, or authenticates a new one using
+// auth unless it is an LMTP server. On Logout the connection is reset and
+// kept for reuse. Idle connections are only reused if their server is the
+// one selected by Balance.
+func (be *Backend) NewPooledSession(auth sasl.Client) (smtp.Session, error) {
+	if len(be.Addrs) == 0 {
+		return nil, errors.New("smtp-proxy: no upstream server configured")
+	}
+	addrs := be.candidates(time.Now())
+	for {
+		ic := be.takeIdle(addrs[0])
+		if ic == nil {
+			break
+		}
+		// The upstream server may have closed the connection meanwhile.
+		if err := probe(ic.c, ic.c.Noop); err != nil {
+			log.Infof("Discarding idle connection to upstream server %s: %s", ic.addr, err)
+			ic.c.Close()
+			be.release(ic.addr)
+			continue
+		}
+		return &session{c: ic.c, be: be, addr: ic.addr, pooled: true}, nil
+	}
+
+	c, addr, err := be.connect(addrs)
+	if err != nil {
+		return nil, err
+	}
+	if be.LMTP {
+		return &session{c: c, be: be, addr: addr, pooled: true}, nil
+	}
+	if err := c.Auth(auth); err != nil {
+		be.closeConn(c, addr)
+		return nil, err
+	}
+	return &session{c: c, be: be, addr: addr, pooled: true}, nil
+}
+
+// takeIdle removes the most recently used idle connection to addr from
+// the pool.
+func (be *Backend) takeIdle(addr string) *idleConn {
+	be.idleMu.Lock()
+	defer be.idleMu.Unlock()
+
+	for idx := len(be.idle) - 1; idx >= 0; idx-- {
+		ic := be.idle[idx]
+		if ic.addr != addr {
+			continue
+		}
+		// A stopped timer has not expired the connection yet, otherwise
+		// expireIdle is about to remove it.
+		if ic.timer.Stop() {
+			be.idle = append(be.idle[:idx], be.idle[idx+1:]...)
+			be.setIdle(addr, -1)
+			return ic
+		}
+	}
+	return nil
+}
+
+// putIdle resets c and keeps it in the pool unless MaxIdlePerHost idle
+// connections to addr are kept already.
+func (be *Backend) putIdle(c *smtp.Client, addr string) {
+	if err := probe(c, c.Reset); err != nil {
+		log.Infof("Discarding connection to upstream server %s: %s", addr, err)
+		c.Close()
+		be.release(addr)
+		return
+	}
+
+	be.idleMu.Lock()
+	count := 0
+	for _, ic := range be.idle {
+		if ic.addr == addr {
+			count++
+		}
+	}
+	if count < be.MaxIdlePerHost {
+		ic := &idleConn{c: c, addr: addr}
+		ic.timer = time.AfterFunc(be.idleTimeout(), func() {
+			be.expireIdle(ic)
+		})
+		be.idle = append(be.idle, ic)
+		be.setIdle(addr, 1)
+		be.idleMu.Unlock()
+		return
+	}
+	be.idleMu.Unlock()
+
+	be.closeConn(c, addr)
+}
+
+func (be *Backend) expireIdle(expired *idleConn) {
+	be.idleMu.Lock()
+	for idx, ic := range be.idle {
+		if ic == expired {
+			be.idle = append(be.idle[:idx], be.idle[idx+1:]...)
+			be.setIdle(expired.addr, -1)
+			break
+		}
+	}
+	be.idleMu.Unlock()
+
+	be.closeConn(expired.c, expired.addr)
+}
@@ -8,8 +8,13 @@ import (
 )
 
 type session struct {
-	c  *smtp.Client
-	be *Backend
+	c    *smtp.Client
+	be   *Backend
+	addr string
+
+	// pooled sessions return their connection to the pool on Logout.
+	pooled bool
+	closed bool
 }
 
 func (s *session) Reset() {
@@ -40,10 +45,22 @@ func (s *session) Data(r io.Reader) error {
 }
 
 func (s *session) Logout() error {
-	return s.c.Quit()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.pooled {
+		s.be.putIdle(s.c, s.addr)
+		return nil
+	}
+	return s.be.closeConn(s.c, s.addr)
 }
 
 func (s *session) AuthPlain(username, password string) error {
 	auth := sasl.NewPlainClient("", username, password)
 	return s.c.Auth(auth)
 }
+
+func (s *session) Auth(auth sasl.Client) error {
+	return s.c.Auth(auth)
+}
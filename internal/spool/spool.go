@@ -0,0 +1,186 @@
+package spool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dataSuffix = ".eml"
+	metaSuffix = ".json"
+	tempPrefix = "tmp-"
+)
+
+// Entry describes a queued message, whose data is stored separately.
+type Entry struct {
+	ID          string `json:"-"`
+	VirtualHost string
+	From        string
+	MailOptions *smtp.MailOptions `json:",omitempty"`
+	To          []string
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+// Spool is a directory of queued messages. Every message is stored as a
+// data file and a metadata file, which is written last, so that only
+// complete messages are listed.
+type Spool struct {
+	dir string
+}
+
+// Open opens the spool directory, creating it if necessary.
+func Open(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir}, nil
+}
+
+// Cleanup removes the temporary files and the data files without metadata
+// left behind by an interrupted Enqueue. It must not run while messages
+// are enqueued, as their data is written before their metadata.
+func (sp *Spool) Cleanup() error {
+	files, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		names[file.Name()] = true
+	}
+	for name := range names {
+		orphan := strings.HasSuffix(name, dataSuffix) &&
+			!names[strings.TrimSuffix(name, dataSuffix)+metaSuffix]
+		if !strings.HasPrefix(name, tempPrefix) && !orphan {
+			continue
+		}
+		log.Warnf("Removing incomplete spool file %s", name)
+		if err := os.Remove(filepath.Join(sp.dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102150405") + "-" + hex.EncodeToString(b), nil
+}
+
+// writeFile atomically replaces the file name with data.
+func (sp *Spool) writeFile(name string, data []byte) error {
+	f, err := ioutil.TempFile(sp.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(sp.dir, name))
+}
+
+// Enqueue stores data for delivery as described by e, whose ID, Created
+// and NextAttempt are set.
+func (sp *Spool) Enqueue(e *Entry, data []byte) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	e.ID = id
+	e.Created = time.Now()
+	e.NextAttempt = e.Created
+	if err := sp.writeFile(id+dataSuffix, data); err != nil {
+		return err
+	}
+	if err := sp.Update(e); err != nil {
+		os.Remove(filepath.Join(sp.dir, id+dataSuffix))
+		return err
+	}
+	return nil
+}
+
+// Update stores the metadata of e.
+func (sp *Spool) Update(e *Entry) error {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return sp.writeFile(e.ID+metaSuffix, meta)
+}
+
+// Remove deletes e and then its data, so that an interrupted Remove leaves
+// unlisted data for Cleanup instead of an entry without data. Data that is
+// already missing is not an error.
+func (sp *Spool) Remove(e *Entry) error {
+	if err := os.Remove(filepath.Join(sp.dir, e.ID+metaSuffix)); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(sp.dir, e.ID+dataSuffix))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Data returns the message data of e.
+func (sp *Spool) Data(e *Entry) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(sp.dir, e.ID+dataSuffix))
+}
+
+// Due returns the entries whose next attempt is not after now, oldest first.
+func (sp *Spool) Due(now time.Time) ([]*Entry, error) {
+	files, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, tempPrefix) || !strings.HasSuffix(name, metaSuffix) {
+			continue
+		}
+		meta, err := ioutil.ReadFile(filepath.Join(sp.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		e := &Entry{ID: strings.TrimSuffix(name, metaSuffix)}
+		if err := json.Unmarshal(meta, e); err != nil {
+			log.Errorf("Skipping malformed spool entry %s: %s", e.ID, err)
+			continue
+		}
+		if !e.NextAttempt.After(now) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
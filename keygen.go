@@ -0,0 +1,128 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func generatePrivKey(algo string, bits int) (crypto.Signer, *pem.Block, error) {
+	switch algo {
+	case "rsa":
+		if bits < 1024 {
+			return nil, nil, fmt.Errorf("RSA key is too short: want at least 1024 bits, got %d bits", bits)
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		block := &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}
+		return key, block, nil
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		block := &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: der,
+		}
+		return key, block, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported key algorithm %q, expected rsa or ed25519", algo)
+	}
+}
+
+func splitTXT(txt string, size int) []string {
+	var parts []string
+	for len(txt) > size {
+		parts = append(parts, txt[:size])
+		txt = txt[size:]
+	}
+	return append(parts, txt)
+}
+
+func formatTXT(name, txt string) string {
+	parts := splitTXT(txt, 255)
+	for i, part := range parts {
+		parts[i] = fmt.Sprintf("%q", part)
+	}
+	return fmt.Sprintf("%s TXT %s", name, strings.Join(parts, " "))
+}
+
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	domain := fs.String("domain", "", "domain the key is used for")
+	selector := fs.String("selector", "", "DKIM selector of the key")
+	algo := fs.String("algo", "rsa", "key algorithm: rsa or ed25519")
+	bits := fs.Int("bits", 2048, "RSA key size in bits")
+	out := fs.String("out", "", "private key file (default \"<selector>.<domain>.pem\")")
+	fs.Parse(args)
+
+	if *domain == "" {
+		return fmt.Errorf("no --domain specified")
+	}
+	if *selector == "" {
+		return fmt.Errorf("no --selector specified")
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("%s.%s.pem", *selector, *domain)
+	}
+
+	key, block, err := generatePrivKey(*algo, *bits)
+	if err != nil {
+		return err
+	}
+	record, err := dkimRecord(key.Public())
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote private key to %s\n", *out)
+	fmt.Println(formatTXT(fmt.Sprintf("%s._domainkey.%s", *selector, *domain), record))
+	return nil
+}
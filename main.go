@@ -20,6 +20,7 @@ package main
 
 import (
 	"crypto/tls"
+	"os"
 	"runtime"
 
 	"github.com/heroku/rollrus"
@@ -43,6 +44,15 @@ func setupServer(cfg *config) (*smtp.Server, bool) {
 		log.Info(vh.Description)
 	}
 
+	if be.Spooler != nil {
+		// No message is enqueued before the server is started.
+		if err := be.Spooler.Cleanup(); err != nil {
+			panic(err)
+		}
+		log.Infof("Delivering queued messages from %s", cfg.Spool.Path)
+		go be.Spooler.run()
+	}
+
 	server := makeServer(cfg, be)
 	if cfg.LetsEncrypt.Agreed {
 		server.TLSConfig, err = makeTLSConfig(cfg)
@@ -61,7 +71,25 @@ func setupServer(cfg *config) (*smtp.Server, bool) {
 	return server, cfg.UseSMTPS
 }
 
+var commands = map[string]func(args []string) error{
+	"keygen":    runKeygen,
+	"dns-check": runDNSCheck,
+	"sign":      runSign,
+	"verify":    runVerify,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		command, found := commands[os.Args[1]]
+		if !found {
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		if err := command(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Info("Loading configuration")
 	cfg, err := loadConfig()
 	if err != nil {
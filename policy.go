@@ -0,0 +1,189 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/mback2k/smtp-dkim-signer/internal/dkimutil"
+)
+
+// singletonHeaderKeys are the header fields that RFC 5322 section 3.6
+// allows at most once per message.
+var singletonHeaderKeys = []string{
+	"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc",
+	"Message-ID", "In-Reply-To", "References", "Subject",
+}
+
+func errInvalidHeader(format string, a ...interface{}) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      fmt.Sprintf(format, a...),
+	}
+}
+
+func checkSingletonHeaders(h dkimutil.Header) error {
+	for _, key := range singletonHeaderKeys {
+		if n := len(h.Values(key)); n > 1 {
+			return errInvalidHeader("Message has %d %s header fields, at most one is allowed", n, key)
+		}
+	}
+	return nil
+}
+
+const (
+	fromPolicyOff       = "off"
+	fromPolicyDomain    = "domain"
+	fromPolicyUser      = "user"
+	fromPolicyAllowList = "allowlist"
+)
+
+// fromPolicy restricts the sender addresses an authenticated user may use
+// in MAIL FROM and in the From header field.
+type fromPolicy struct {
+	Mode    string
+	Domain  string
+	Allowed map[string][]string
+}
+
+func makeFromPolicy(cfgvh *configVHost) (*fromPolicy, error) {
+	mode := strings.ToLower(cfgvh.FromPolicy)
+	switch mode {
+	case "", fromPolicyOff:
+		return nil, nil
+	case fromPolicyDomain, fromPolicyUser, fromPolicyAllowList:
+	default:
+		return nil, fmt.Errorf("unknown FromPolicy %q", cfgvh.FromPolicy)
+	}
+
+	domain, err := parentDomain(cfgvh.Domain)
+	if err != nil {
+		return nil, err
+	}
+	policy := &fromPolicy{
+		Mode:    mode,
+		Domain:  domain,
+		Allowed: make(map[string][]string),
+	}
+	for idx, allowed := range cfgvh.AllowedFrom {
+		if allowed.User == "" {
+			return nil, fmt.Errorf("AllowedFrom #%d has no User", idx)
+		}
+		user := strings.ToLower(allowed.User)
+		for _, addr := range allowed.Addresses {
+			policy.Allowed[user] = append(policy.Allowed[user], strings.ToLower(addr))
+		}
+	}
+	return policy, nil
+}
+
+func addressDomain(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return ""
+	}
+	return addr[at+1:]
+}
+
+// allows reports whether user may send as addr in a session for domain,
+// the domain matched by the VirtualHost. In domain mode addr must be within
+// domain or the VirtualHost domain, which is the parent domain signed as d=
+// for a wildcard VirtualHost, so that a subdomain cannot send as another one.
+// In allowlist mode a user may always send as itself and as every address
+// or @domain listed for it.
+func (p *fromPolicy) allows(user, domain, addr string) bool {
+	user = strings.ToLower(user)
+	addr = strings.ToLower(addr)
+	switch p.Mode {
+	case fromPolicyDomain:
+		addrDomain := addressDomain(addr)
+		return addrDomain == p.Domain || (domain != "" && addrDomain == domain)
+	case fromPolicyUser:
+		return addr == user
+	case fromPolicyAllowList:
+		if addr == user {
+			return true
+		}
+		for _, allowed := range p.Allowed[user] {
+			if allowed == addr || (strings.HasPrefix(allowed, "@") && allowed[1:] == addressDomain(addr)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkFromHeader checks every mailbox of the From header field of h.
+func (p *fromPolicy) checkFromHeader(h dkimutil.Header, user, domain string) error {
+	values := h.Values("From")
+	if len(values) == 0 {
+		return errInvalidHeader("Message has no From header field")
+	}
+	for _, value := range values {
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			return errInvalidHeader("Message has a malformed From header field")
+		}
+		for _, addr := range addrs {
+			if !p.allows(user, domain, addr.Address) {
+				return fmt.Errorf("%w: %s", ErrFromNotAllowed, addr.Address)
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	authzidPolicySame   = "same"
+	authzidPolicyDomain = "domain"
+	authzidPolicyAny    = "any"
+)
+
+func makeAuthzidPolicy(policy string) (string, error) {
+	switch mode := strings.ToLower(policy); mode {
+	case "":
+		return authzidPolicySame, nil
+	case authzidPolicySame, authzidPolicyDomain, authzidPolicyAny:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown AuthzidPolicy %q", policy)
+	}
+}
+
+// authorizes reports whether the authentication identity authcid may act
+// as the authorization identity authzid of SASL PLAIN (RFC 4616). The
+// upstream server still has to accept authzid for the authentication to
+// succeed.
+func authorizes(policy, authcid, authzid string) bool {
+	if authzid == "" || strings.EqualFold(authzid, authcid) {
+		return true
+	}
+	switch policy {
+	case authzidPolicyDomain:
+		domain := strings.ToLower(addressDomain(authzid))
+		return domain != "" && domain == strings.ToLower(addressDomain(authcid))
+	case authzidPolicyAny:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mback2k/smtp-dkim-signer/internal/dkimutil"
+)
+
+func TestFromPolicyAllows(t *testing.T) {
+	policy := func(mode, domain string) *fromPolicy {
+		p, err := makeFromPolicy(&configVHost{
+			Domain:     domain,
+			FromPolicy: mode,
+			AllowedFrom: []*configAllowedFrom{
+				{User: "Alice@example.com", Addresses: []string{"sales@example.com", "@example.org"}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	for _, tc := range []struct {
+		policy *fromPolicy
+		user   string
+		domain string
+		addr   string
+		want   bool
+	}{
+		{policy("domain", "example.com"), "alice@example.com", "example.com", "bob@Example.com", true},
+		{policy("domain", "example.com"), "alice@example.com", "example.com", "bob@example.org", false},
+		{policy("domain", "example.com"), "alice@example.com", "example.com", "bob@sub.example.com", false},
+		{policy("domain", "*.example.com"), "alice@a.example.com", "a.example.com", "bob@a.example.com", true},
+		{policy("domain", "*.example.com"), "alice@a.example.com", "a.example.com", "bob@example.com", true},
+		{policy("domain", "*.example.com"), "alice@a.example.com", "a.example.com", "bob@b.example.com", false},
+		{policy("domain", "*.example.com"), "alice", "", "bob@b.example.com", false},
+		{policy("domain", "*.example.com"), "alice", "", "bob@example.com", true},
+		{policy("user", "example.com"), "alice@example.com", "example.com", "ALICE@example.com", true},
+		{policy("user", "example.com"), "alice@example.com", "example.com", "bob@example.com", false},
+		{policy("allowlist", "example.com"), "alice@example.com", "example.com", "alice@example.com", true},
+		{policy("allowlist", "example.com"), "alice@example.com", "example.com", "sales@example.com", true},
+		{policy("allowlist", "example.com"), "alice@example.com", "example.com", "anyone@example.org", true},
+		{policy("allowlist", "example.com"), "alice@example.com", "example.com", "anyone@example.com", false},
+		{policy("allowlist", "example.com"), "bob@example.com", "example.com", "sales@example.com", false},
+	} {
+		if got := tc.policy.allows(tc.user, tc.domain, tc.addr); got != tc.want {
+			t.Errorf("FromPolicy %s of %s allows(%q, %q, %q) = %t, want %t", tc.policy.Mode, tc.policy.Domain, tc.user, tc.domain, tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestFromPolicyCheckFromHeader(t *testing.T) {
+	p, err := makeFromPolicy(&configVHost{Domain: "*.example.com", FromPolicy: "domain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		header     dkimutil.Header
+		wantErr    bool
+		notAllowed bool
+	}{
+		{dkimutil.Header{"From: Alice <alice@a.example.com>\r\n"}, false, false},
+		{dkimutil.Header{"From: alice@a.example.com, news@example.com\r\n"}, false, false},
+		{dkimutil.Header{"From: alice@a.example.com, mallory@b.example.com\r\n"}, true, true},
+		{dkimutil.Header{"From: alice@a.example.com\r\n", "From: mallory@b.example.com\r\n"}, true, true},
+		{dkimutil.Header{"To: bob@example.net\r\n"}, true, false},
+		{dkimutil.Header{"From: not an address\r\n"}, true, false},
+	} {
+		err := p.checkFromHeader(tc.header, "alice@a.example.com", "a.example.com")
+		if (err != nil) != tc.wantErr || errors.Is(err, ErrFromNotAllowed) != tc.notAllowed {
+			t.Errorf("checkFromHeader(%q) = %v, want error %t, not allowed %t", tc.header, err, tc.wantErr, tc.notAllowed)
+		}
+	}
+}
+
+func TestAuthorizes(t *testing.T) {
+	for _, tc := range []struct {
+		policy  string
+		authcid string
+		authzid string
+		want    bool
+	}{
+		{authzidPolicySame, "alice@example.com", "", true},
+		{authzidPolicySame, "alice@example.com", "ALICE@example.com", true},
+		{authzidPolicySame, "alice@example.com", "bob@example.com", false},
+		{authzidPolicyDomain, "alice@example.com", "bob@Example.com", true},
+		{authzidPolicyDomain, "alice@example.com", "bob@example.org", false},
+		{authzidPolicyDomain, "alice", "bob", false},
+		{authzidPolicyAny, "alice@example.com", "bob@example.org", true},
+	} {
+		if got := authorizes(tc.policy, tc.authcid, tc.authzid); got != tc.want {
+			t.Errorf("authorizes(%s, %q, %q) = %t, want %t", tc.policy, tc.authcid, tc.authzid, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/mback2k/smtp-dkim-signer/internal/dkimutil"
+)
+
+// VirtualHost resolution strategies, selecting the VirtualHost by the
+// domain of the login, of MAIL FROM, of the From header field or by the
+// UserVirtualHosts mapping of the login.
+const (
+	resolveLogin    = "login"
+	resolveMailFrom = "mailfrom"
+	resolveHeader   = "header"
+	resolveMapping  = "mapping"
+)
+
+func makeResolution(resolution string) (string, error) {
+	switch mode := strings.ToLower(resolution); mode {
+	case "":
+		return resolveLogin, nil
+	case resolveLogin, resolveMailFrom, resolveHeader, resolveMapping:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown VHostResolution %q", resolution)
+	}
+}
+
+// resolvesAtLogin reports whether the VirtualHost is known on AUTH.
+func (bkd *backend) resolvesAtLogin() bool {
+	return bkd.Resolution == resolveLogin || bkd.Resolution == resolveMapping
+}
+
+// loginVHost returns the VirtualHost for login, which is looked up in
+// UserVirtualHosts first if that mapping is used, and the matched domain.
+func (bkd *backend) loginVHost(login string) (*backendVHost, string) {
+	if bkd.Resolution == resolveMapping {
+		if bkdvh, found := bkd.UserVHosts[login]; found {
+			return bkdvh, ""
+		}
+	}
+	return bkd.lookupVHost(addressDomain(login))
+}
+
+// grantsVHost reports whether login may sign with and relay through
+// bkdvh, which is the VirtualHost of its domain, the one it is mapped to by
+// UserVirtualHosts or one listing it in AllowedFrom.
+func (bkd *backend) grantsVHost(login string, bkdvh *backendVHost) bool {
+	if own, _ := bkd.lookupVHost(addressDomain(login)); own == bkdvh {
+		return true
+	}
+	if mapped, found := bkd.UserVHosts[login]; found && mapped == bkdvh {
+		return true
+	}
+	policy := bkdvh.FromPolicy
+	return policy != nil && policy.Mode == fromPolicyAllowList && len(policy.Allowed[strings.ToLower(login)]) > 0
+}
+
+// lookupVHost returns the VirtualHost for domain and the lower-cased domain.
+// A VirtualHost for exactly the domain takes precedence over wildcard
+// VirtualHosts, of which the one for the longest parent domain is used.
+// A domain containing a wildcard never matches, as it would be looked up
+// as a wildcard VirtualHost itself.
+func (bkd *backend) lookupVHost(domain string) (*backendVHost, string) {
+	domain = strings.ToLower(domain)
+	if domain == "" || strings.Contains(domain, "*") {
+		return nil, ""
+	}
+	if bkdvh, found := bkd.VHosts[domain]; found {
+		return bkdvh, domain
+	}
+	for parent := domain; strings.Contains(parent, "."); {
+		parent = parent[strings.Index(parent, ".")+1:]
+		if bkdvh, found := bkd.VHosts["*."+parent]; found {
+			return bkdvh, domain
+		}
+	}
+	return nil, ""
+}
+
+// parentDomain returns the domain of a VirtualHost, which is the parent
+// domain for a wildcard VirtualHost like *.example.com.
+func parentDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "*."))
+	if domain == "" || strings.Contains(domain, "*") {
+		return "", fmt.Errorf("only a leading wildcard label *. is supported")
+	}
+	return domain, nil
+}
+
+// headerFromAddress returns the first address of the From header field.
+func headerFromAddress(msg []byte) (string, error) {
+	m, err := dkimutil.ParseMessage(msg)
+	if err != nil {
+		return "", err
+	}
+	values := m.Header.Values("From")
+	if len(values) == 0 {
+		return "", fmt.Errorf("missing From header field")
+	}
+	addrs, err := mail.ParseAddressList(values[0])
+	if err != nil {
+		return "", err
+	}
+	return addrs[0].Address, nil
+}
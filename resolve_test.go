@@ -0,0 +1,53 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "testing"
+
+func TestLookupVHost(t *testing.T) {
+	exact := &backendVHost{Domain: "example.com"}
+	wildcard := &backendVHost{Domain: "*.example.com"}
+	nested := &backendVHost{Domain: "*.b.example.com"}
+	be := &backend{VHosts: map[string]*backendVHost{
+		exact.Domain:    exact,
+		wildcard.Domain: wildcard,
+		nested.Domain:   nested,
+	}}
+	for _, tc := range []struct {
+		domain     string
+		want       *backendVHost
+		wantDomain string
+	}{
+		{"example.com", exact, "example.com"},
+		{"Example.COM", exact, "example.com"},
+		{"a.example.com", wildcard, "a.example.com"},
+		{"x.a.example.com", wildcard, "x.a.example.com"},
+		{"b.example.com", wildcard, "b.example.com"},
+		{"x.b.example.com", nested, "x.b.example.com"},
+		{"example.org", nil, ""},
+		{"*.example.com", nil, ""},
+		{"*.a.example.com", nil, ""},
+		{"", nil, ""},
+	} {
+		got, domain := be.lookupVHost(tc.domain)
+		if got != tc.want || domain != tc.wantDomain {
+			t.Errorf("lookupVHost(%q) = %v, %q, want %v, %q", tc.domain, got, domain, tc.want, tc.wantDomain)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	dkim "github.com/emersion/go-msgauth/dkim"
+	"github.com/mback2k/smtp-dkim-signer/internal/dkimutil"
+)
+
+// maxVerifications limits the DNS lookups done for existing signatures.
+const maxVerifications = 5
+
+// dkimResults verifies the existing DKIM signatures of msg.
+func dkimResults(msg []byte) []authres.Result {
+	verifs, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT:        lookupTXT,
+		MaxVerifications: maxVerifications,
+	})
+	if err != nil && err != dkim.ErrTooManySignatures {
+		return []authres.Result{&authres.DKIMResult{Value: authres.ResultPermError, Reason: err.Error()}}
+	}
+	if len(verifs) == 0 {
+		return []authres.Result{&authres.DKIMResult{Value: authres.ResultNone}}
+	}
+
+	results := make([]authres.Result, 0, len(verifs))
+	for _, verif := range verifs {
+		res := &authres.DKIMResult{
+			Value:      authres.ResultPass,
+			Domain:     verif.Domain,
+			Identifier: verif.Identifier,
+		}
+		if verif.Err != nil {
+			switch {
+			case dkim.IsTempFail(verif.Err):
+				res.Value = authres.ResultTempError
+			case dkim.IsPermFail(verif.Err):
+				res.Value = authres.ResultPermError
+			default:
+				res.Value = authres.ResultFail
+			}
+			res.Reason = strings.TrimPrefix(verif.Err.Error(), "dkim: ")
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// submissionResults describes the submission of msg by user, which is empty
+// for unauthenticated clients, and the verification of its existing DKIM
+// signatures.
+func submissionResults(msg []byte, user string) []authres.Result {
+	auth := &authres.AuthResult{Value: authres.ResultPass, Auth: user}
+	if user == "" {
+		auth.Value = authres.ResultNone
+	}
+	return append([]authres.Result{auth}, dkimResults(msg)...)
+}
+
+// formatAuthResults formats the value of an Authentication-Results header
+// field with one result per line.
+func formatAuthResults(authservID string, results []authres.Result) string {
+	if len(results) == 0 {
+		return authres.Format(authservID, nil)
+	}
+	parts := []string{authservID}
+	for _, result := range results {
+		s := authres.Format(authservID, []authres.Result{result})
+		parts = append(parts, strings.TrimSpace(strings.TrimPrefix(s, authservID+";")))
+	}
+	return strings.Join(parts, ";\r\n\t")
+}
+
+// authservIDOf returns the authserv-id of an Authentication-Results value.
+func authservIDOf(value string) string {
+	fields := strings.Fields(strings.SplitN(value, ";", 2)[0])
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// stripAuthResults removes the Authentication-Results header fields of m
+// claiming to be added by authservID, as only we may add those (RFC 8601
+// section 5), and returns the number of removed fields.
+func stripAuthResults(m *dkimutil.Message, authservID string) int {
+	var h dkimutil.Header
+	for _, kv := range m.Header {
+		k, v := dkimutil.ParseField(kv)
+		if strings.EqualFold(k, "Authentication-Results") && strings.EqualFold(authservIDOf(v), authservID) {
+			continue
+		}
+		h = append(h, kv)
+	}
+	removed := len(m.Header) - len(h)
+	m.Header = h
+	return removed
+}
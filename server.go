@@ -26,6 +26,7 @@ import (
 	certmagic "github.com/caddyserver/certmagic"
 	"github.com/emersion/go-sasl"
 	smtp "github.com/emersion/go-smtp"
+	"github.com/mback2k/smtp-dkim-signer/internal/saslutil"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -38,6 +39,25 @@ func makeServer(cfg *config, be *backend) *smtp.Server {
 	s.MaxMessageBytes = cfg.MaxMessageBytes
 	s.MaxRecipients = cfg.MaxRecipients
 	s.AllowInsecureAuth = cfg.AllowInsecureAuth
+	s.EnableAuth(sasl.Plain, func(conn *smtp.Conn) sasl.Server {
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return conn.Session().(*sessionState).authenticate(identity, username, password)
+		})
+	})
+	s.EnableAuth(saslutil.XOAuth2, func(conn *smtp.Conn) sasl.Server {
+		return saslutil.NewXOAuth2Server(func(username, token string) error {
+			return conn.Session().(*sessionState).authenticateXOAuth2(username, token)
+		})
+	})
+	s.EnableAuth(sasl.OAuthBearer, func(conn *smtp.Conn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if err := conn.Session().(*sessionState).authenticateOAuthBearer(opts); err != nil {
+				log.Infof("Auth failed: OAUTHBEARER for %q: %s", opts.Username, err)
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			return nil
+		})
+	})
 	s.EnableAuth(sasl.Login, func(conn *smtp.Conn) sasl.Server {
 		return sasl.NewLoginServer(func(username, password string) error {
 			return conn.Session().AuthPlain(username, password)
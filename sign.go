@@ -0,0 +1,83 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+func readMessage(r io.Reader) ([]byte, error) {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Message files usually have local line endings, but signing and
+	// verification operate on the SMTP wire format.
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	msg = bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+	return msg, nil
+}
+
+func runSign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	vhost := fs.String("vhost", "", "domain of the VirtualHost to sign for")
+	user := fs.String("user", "", "authenticated user for the identity template")
+	fs.Parse(args)
+
+	if *vhost == "" {
+		return fmt.Errorf("no --vhost specified")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	// Only the signing state is set up, so that signing has no side
+	// effects like creating the spool or connecting upstream.
+	be := &backend{VHosts: make(map[string]*backendVHost)}
+	for idx, cfgvh := range cfg.VirtualHosts {
+		vhostbe, err := makeSigningVHost(cfg, cfgvh)
+		if err != nil {
+			return fmt.Errorf("unable to setup VirtualHost #%d due to: %s", idx, err)
+		}
+		be.VHosts[vhostbe.Domain] = vhostbe
+	}
+	bkdvh, domain := be.lookupVHost(*vhost)
+	if bkdvh == nil {
+		return fmt.Errorf("VirtualHost %q not found", *vhost)
+	}
+
+	msg, err := readMessage(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	s := &sessionState{backend: be, bkdvh: bkdvh, domain: domain, username: *user}
+	signed, err := s.prepareMessage(bytes.NewReader(msg), s.generateMessageID())
+	if err != nil {
+		return err
+	}
+	_, err = signed.WriteTo(os.Stdout)
+	return err
+}
@@ -0,0 +1,428 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/mback2k/smtp-dkim-signer/internal/dkimutil"
+	"github.com/mback2k/smtp-dkim-signer/internal/spool"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default spool settings, used if not configured.
+const (
+	defaultSpoolLifetime         = 5 * 24 * time.Hour
+	defaultSpoolRetryInterval    = time.Minute
+	defaultSpoolMaxRetryInterval = time.Hour
+)
+
+// spooler delivers queued messages with the upstream credentials of their
+// VirtualHost and bounces them to the envelope sender once they failed
+// permanently or their lifetime expired.
+type spooler struct {
+	*spool.Spool
+	backend *backend
+
+	Domain           string
+	Lifetime         time.Duration
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	wake chan struct{}
+}
+
+func makeSpooler(cfg *config, be *backend) (*spooler, error) {
+	if cfg.Spool == nil || cfg.Spool.Path == "" {
+		return nil, nil
+	}
+	sp, err := spool.Open(cfg.Spool.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open Spool.Path due to: %s", err)
+	}
+	spr := &spooler{
+		Spool:            sp,
+		backend:          be,
+		Domain:           cfg.Domain,
+		Lifetime:         cfg.Spool.Lifetime,
+		RetryInterval:    cfg.Spool.RetryInterval,
+		MaxRetryInterval: cfg.Spool.MaxRetryInterval,
+		wake:             make(chan struct{}, 1),
+	}
+	if spr.Lifetime <= 0 {
+		spr.Lifetime = defaultSpoolLifetime
+	}
+	if spr.RetryInterval <= 0 {
+		spr.RetryInterval = defaultSpoolRetryInterval
+	}
+	if spr.MaxRetryInterval <= 0 {
+		spr.MaxRetryInterval = defaultSpoolMaxRetryInterval
+	}
+	if spr.MaxRetryInterval < spr.RetryInterval {
+		return nil, fmt.Errorf("Spool.MaxRetryInterval must not be less than Spool.RetryInterval")
+	}
+	return spr, nil
+}
+
+// enqueue queues a message and wakes up the delivery worker.
+func (spr *spooler) enqueue(vhost, from string, opts *smtp.MailOptions, to []string, data []byte) (*spool.Entry, error) {
+	e := &spool.Entry{VirtualHost: vhost, From: from, MailOptions: opts, To: to}
+	if err := spr.Enqueue(e, data); err != nil {
+		return nil, err
+	}
+	select {
+	case spr.wake <- struct{}{}:
+	default:
+	}
+	return e, nil
+}
+
+// run delivers due messages whenever one was queued and at least once per
+// RetryInterval.
+func (spr *spooler) run() {
+	ticker := time.NewTicker(spr.RetryInterval)
+	defer ticker.Stop()
+	for {
+		entries, err := spr.Due(time.Now())
+		if err != nil {
+			log.WithError(err).Errorf("Reading spool failed: %s", err)
+		}
+		for _, e := range entries {
+			spr.deliver(e)
+		}
+		select {
+		case <-ticker.C:
+		case <-spr.wake:
+		}
+	}
+}
+
+// isPermanent reports whether err is a permanent SMTP failure.
+func isPermanent(err error) bool {
+	smtpErr, ok := err.(*smtp.SMTPError)
+	return ok && smtpErr.Code >= 500
+}
+
+// failedRecipient is a recipient that is bounced with the error.
+type failedRecipient struct {
+	To  string
+	Err error
+}
+
+func (spr *spooler) deliver(e *spool.Entry) {
+	logger := log.WithField("message", e.ID)
+
+	bkdvh, found := spr.backend.VHosts[e.VirtualHost]
+	if !found || !bkdvh.LocalAuth {
+		// The configuration changed, keep the message for a later one
+		// unless it expired, as it cannot be bounced without upstream.
+		err := fmt.Errorf("VirtualHost %q is not available for the spool", e.VirtualHost)
+		if time.Since(e.Created) < spr.Lifetime {
+			spr.retry(e, nil, err)
+			return
+		}
+		logger.Errorf("Dropping expired queued message %s: %s", e.ID, err)
+		if err := spr.Remove(e); err != nil {
+			logger.WithError(err).Errorf("Removing queued message %s failed: %s", e.ID, err)
+		}
+		return
+	}
+	data, err := spr.Data(e)
+	if os.IsNotExist(err) {
+		// The message cannot be delivered anymore, so its recipients
+		// are reported to the sender.
+		logger.WithError(err).Errorf("Lost queued message %s from %s to %s: %s", e.ID, e.From, e.To, err)
+		var failed []failedRecipient
+		for _, to := range e.To {
+			failed = append(failed, failedRecipient{to, fmt.Errorf("message data was lost from the spool")})
+		}
+		spr.bounce(bkdvh, e, nil, failed)
+		if err := spr.Remove(e); err != nil {
+			logger.WithError(err).Errorf("Removing queued message %s failed: %s", e.ID, err)
+		}
+		return
+	} else if err != nil {
+		logger.WithError(err).Errorf("Reading queued message %s failed: %s", e.ID, err)
+		return
+	}
+
+	var failed []failedRecipient
+	retry, err := spr.send(bkdvh, e, data, &failed)
+	if err != nil {
+		if isPermanent(err) {
+			for _, to := range retry {
+				failed = append(failed, failedRecipient{to, err})
+			}
+			retry = nil
+		} else if time.Since(e.Created) >= spr.Lifetime {
+			for _, to := range retry {
+				failed = append(failed, failedRecipient{to, fmt.Errorf("delivery time expired, last error: %s", err)})
+			}
+			retry = nil
+		}
+	}
+
+	if len(failed) > 0 {
+		spr.bounce(bkdvh, e, data, failed)
+	}
+	if len(retry) > 0 {
+		spr.retry(e, retry, err)
+		return
+	}
+	if err := spr.Remove(e); err != nil {
+		logger.WithError(err).Errorf("Removing queued message %s failed: %s", e.ID, err)
+		return
+	}
+	if len(failed) == 0 {
+		logger.Infof("Delivered queued message %s from %s to %s", e.ID, e.From, e.To)
+	}
+}
+
+// send delivers data to the recipients of e. Rejected recipients are added
+// to failed, the recipients to retry are returned with the error. Only the
+// replies to MAIL, RCPT and DATA can fail permanently, a rejected connection
+// or AUTH is retried as it is no verdict on the message.
+func (spr *spooler) send(bkdvh *backendVHost, e *spool.Entry, data []byte, failed *[]failedRecipient) ([]string, error) {
+	session, err := openUpstream(bkdvh, bkdvh.upstreamClient())
+	if err != nil {
+		return e.To, fmt.Errorf("unable to connect to upstream due to: %s", err)
+	}
+	defer session.Logout()
+
+	if err := session.Mail(e.From, e.MailOptions); err != nil {
+		session.Reset()
+		return e.To, err
+	}
+	var accepted, deferred []string
+	var rcptErr error
+	for _, to := range e.To {
+		err := session.Rcpt(to)
+		switch {
+		case err == nil:
+			accepted = append(accepted, to)
+		case isPermanent(err):
+			*failed = append(*failed, failedRecipient{to, err})
+		default:
+			deferred = append(deferred, to)
+			rcptErr = err
+		}
+	}
+	if len(accepted) == 0 {
+		session.Reset()
+		return deferred, rcptErr
+	}
+	if err := session.Data(bytes.NewReader(data)); err != nil {
+		return append(accepted, deferred...), err
+	}
+	return deferred, rcptErr
+}
+
+// retry schedules the next delivery attempt of e to the recipients to,
+// unless to is nil, with an exponential backoff.
+func (spr *spooler) retry(e *spool.Entry, to []string, err error) {
+	if to != nil {
+		e.To = to
+	}
+	e.Attempts++
+	e.LastError = err.Error()
+	backoff := spr.RetryInterval
+	for i := 1; i < e.Attempts && backoff < spr.MaxRetryInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > spr.MaxRetryInterval {
+		backoff = spr.MaxRetryInterval
+	}
+	e.NextAttempt = time.Now().Add(backoff)
+
+	logger := log.WithField("message", e.ID)
+	logger.Warnf("Delivery of queued message %s to %s failed, retrying in %s: %s", e.ID, e.To, backoff, err)
+	if err := spr.Update(e); err != nil {
+		logger.WithError(err).Errorf("Updating queued message %s failed: %s", e.ID, err)
+	}
+}
+
+// bounce queues a delivery status notification (RFC 3464) for the failed
+// recipients to the envelope sender of e.
+func (spr *spooler) bounce(bkdvh *backendVHost, e *spool.Entry, data []byte, failed []failedRecipient) {
+	logger := log.WithField("message", e.ID)
+	for _, f := range failed {
+		logger.Warnf("Delivery of queued message %s to %s failed permanently: %s", e.ID, f.To, f.Err)
+	}
+	if e.From == "" {
+		// Never bounce a bounce.
+		logger.Warnf("Dropping queued message %s with null sender", e.ID)
+		return
+	}
+
+	dsn, err := spr.signBounce(bkdvh, e, data, failed)
+	if err == nil {
+		var b *spool.Entry
+		b, err = spr.enqueue(e.VirtualHost, "", nil, []string{e.From}, dsn)
+		if err == nil {
+			logger.Infof("Queued bounce %s of message %s to %s", b.ID, e.ID, e.From)
+			return
+		}
+	}
+	logger.WithError(err).Errorf("Queueing bounce of message %s failed: %s", e.ID, err)
+}
+
+// signBounce creates the bounce of e from MAILER-DAEMON of the VirtualHost
+// domain and DKIM-signs it with the active keys of the VirtualHost, so that
+// it passes DMARC of that domain like the messages it relays. Without an
+// active key the bounce is sent unsigned rather than lost.
+func (spr *spooler) signBounce(bkdvh *backendVHost, e *spool.Entry, data []byte, failed []failedRecipient) ([]byte, error) {
+	now := time.Now()
+	dkimopts := activeOptions(bkdvh.Signers, now)
+	if len(dkimopts) == 0 {
+		log.WithField("message", e.ID).Warnf("Sending unsigned bounce of message %s: %s", e.ID, ErrNoActiveKey)
+		return spr.makeBounce(e, data, failed, e.VirtualHost)
+	}
+	dkimopts = messageOptions(dkimopts, "", "", bkdvh.SignatureLifetime, now)
+
+	dsn, err := spr.makeBounce(e, data, failed, dkimopts[0].Domain)
+	if err != nil {
+		return nil, err
+	}
+	var signed bytes.Buffer
+	if err := signAll(&signed, bytes.NewReader(dsn), dkimopts, bkdvh.BodyLength); err != nil {
+		return nil, fmt.Errorf("unable to sign bounce due to: %s", err)
+	}
+	return signed.Bytes(), nil
+}
+
+func (spr *spooler) makeBounce(e *spool.Entry, data []byte, failed []failedRecipient, domain string) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "Your message could not be delivered to the following recipients:\r\n\r\n")
+	for _, f := range failed {
+		fmt.Fprintf(&text, "  %s: %s\r\n", f.To, f.Err)
+	}
+	if err := writePart(mw, "text/plain; charset=utf-8", text.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var status bytes.Buffer
+	fmt.Fprintf(&status, "Reporting-MTA: dns; %s\r\nArrival-Date: %s\r\n", spr.Domain, e.Created.Format(time.RFC1123Z))
+	for _, f := range failed {
+		code := "5.0.0"
+		if smtpErr, ok := f.Err.(*smtp.SMTPError); ok && smtpErr.EnhancedCode[0] == 5 {
+			code = fmt.Sprintf("%d.%d.%d", smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2])
+		} else if !isPermanent(f.Err) {
+			code = "4.4.7"
+		}
+		diagnostic := strings.NewReplacer("\r", " ", "\n", " ").Replace(f.Err.Error())
+		fmt.Fprintf(&status, "\r\nFinal-Recipient: rfc822; %s\r\nAction: failed\r\nStatus: %s\r\nDiagnostic-Code: smtp; %s\r\n", f.To, code, diagnostic)
+	}
+	if err := writePart(mw, "message/delivery-status", status.Bytes()); err != nil {
+		return nil, err
+	}
+
+	headers := data
+	if m, err := dkimutil.ParseMessage(data); err == nil {
+		headers = []byte(strings.Join(m.Header, ""))
+	}
+	if err := writePart(mw, "text/rfc822-headers", headers); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", domain)
+	fmt.Fprintf(&msg, "To: <%s>\r\n", e.From)
+	fmt.Fprintf(&msg, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s.%d@%s>\r\n", e.ID, e.Attempts, spr.Domain)
+	fmt.Fprintf(&msg, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func writePart(mw *multipart.Writer, contentType string, content []byte) error {
+	w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// spoolSession accepts a transaction into the spool instead of relaying it
+// to the upstream server.
+type spoolSession struct {
+	spooler *spooler
+	vhost   string
+
+	from string
+	opts *smtp.MailOptions
+	to   []string
+}
+
+func (s *spoolSession) Reset() {
+	s.from = ""
+	s.opts = nil
+	s.to = nil
+}
+
+func (s *spoolSession) Logout() error {
+	return nil
+}
+
+func (s *spoolSession) AuthPlain(username, password string) error {
+	return smtp.ErrAuthUnsupported
+}
+
+func (s *spoolSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	s.opts = opts
+	return nil
+}
+
+func (s *spoolSession) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *spoolSession) Data(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	e, err := s.spooler.enqueue(s.vhost, s.from, s.opts, s.to, data)
+	if err != nil {
+		log.WithError(err).Errorf("Queueing message from %s to %s failed: %s", s.from, s.to, err)
+		return ErrSpoolFailed
+	}
+	log.WithField("message", e.ID).Infof("Queued message %s from %s to %s", e.ID, s.from, s.to)
+	return nil
+}
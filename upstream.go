@@ -0,0 +1,160 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mback2k/smtp-dkim-signer/internal/smtpproxy"
+	"github.com/mback2k/smtp-dkim-signer/internal/tlsutil"
+)
+
+// Upstream security modes: implicit TLS, STARTTLS, plaintext SMTP and
+// LMTP over a unix socket.
+const (
+	upstreamSecurityTLS      = "tls"
+	upstreamSecurityStartTLS = "starttls"
+	upstreamSecurityNone     = "none"
+	upstreamSecurityLMTP     = "lmtp"
+)
+
+var upstreamBalances = map[string]smtpproxy.Balance{
+	"":           smtpproxy.BalanceFailover,
+	"failover":   smtpproxy.BalanceFailover,
+	"roundrobin": smtpproxy.BalanceRoundRobin,
+	"leastconn":  smtpproxy.BalanceLeastConn,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func makeUpstreamTLSConfig(cfgtls *configUpstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if cfgtls == nil {
+		return tlsConfig, nil
+	}
+	tlsConfig.ServerName = cfgtls.ServerName
+	if cfgtls.MinVersion != "" {
+		version, found := tlsVersions[cfgtls.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown UpstreamTLS.MinVersion %q", cfgtls.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if cfgtls.CAPath != "" {
+		pem, err := ioutil.ReadFile(cfgtls.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load UpstreamTLS.CAPath due to: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in UpstreamTLS.CAPath")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfgtls.CertPath != "" || cfgtls.KeyPath != "" {
+		if cfgtls.CertPath == "" || cfgtls.KeyPath == "" {
+			return nil, fmt.Errorf("UpstreamTLS.CertPath and UpstreamTLS.KeyPath must be specified together")
+		}
+		kpr, err := tlsutil.NewKeypairReloader(cfgtls.CertPath, cfgtls.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load UpstreamTLS client certificate due to: %s", err)
+		}
+		tlsConfig.GetClientCertificate = kpr.GetClientCertificateFunc()
+	}
+	return tlsConfig, nil
+}
+
+func makeUpstream(cfgvh *configVHost) (*smtpproxy.Backend, error) {
+	if len(cfgvh.Upstream) == 0 {
+		return nil, fmt.Errorf("no VirtualHost.Upstream specified")
+	}
+	for _, addr := range cfgvh.Upstream {
+		if addr == "" {
+			return nil, fmt.Errorf("empty address in VirtualHost.Upstream")
+		}
+	}
+
+	var be *smtpproxy.Backend
+	switch security := strings.ToLower(cfgvh.UpstreamSecurity); security {
+	case "", upstreamSecurityTLS, upstreamSecurityStartTLS:
+		tlsConfig, err := makeUpstreamTLSConfig(cfgvh.UpstreamTLS)
+		if err != nil {
+			return nil, err
+		}
+		if security == upstreamSecurityStartTLS {
+			be = smtpproxy.New(cfgvh.Upstream)
+			be.TLSConfig = tlsConfig
+		} else {
+			be = smtpproxy.NewTLS(cfgvh.Upstream, tlsConfig)
+		}
+	case upstreamSecurityNone:
+		be = smtpproxy.New(cfgvh.Upstream)
+		be.Security = smtpproxy.SecurityNone
+	case upstreamSecurityLMTP:
+		// The server name of a unix socket is only informational, the
+		// client introduces itself with LocalName in LHLO.
+		be = smtpproxy.NewLMTP(cfgvh.Upstream, "localhost")
+	default:
+		return nil, fmt.Errorf("unknown VirtualHost.UpstreamSecurity %q", cfgvh.UpstreamSecurity)
+	}
+	if cfgvh.UpstreamTLS != nil && be.TLSConfig == nil {
+		return nil, fmt.Errorf("UpstreamTLS requires UpstreamSecurity %s or %s", upstreamSecurityTLS, upstreamSecurityStartTLS)
+	}
+	be.LocalName = cfgvh.LocalName
+
+	if cfgvh.UpstreamDialTimeout < 0 {
+		return nil, fmt.Errorf("VirtualHost.UpstreamDialTimeout must not be negative")
+	}
+	be.DialTimeout = cfgvh.UpstreamDialTimeout
+
+	balance, found := upstreamBalances[strings.ToLower(cfgvh.UpstreamBalance)]
+	if !found {
+		return nil, fmt.Errorf("unknown VirtualHost.UpstreamBalance %q", cfgvh.UpstreamBalance)
+	}
+	if len(cfgvh.UpstreamWeights) > 0 && len(cfgvh.UpstreamWeights) != len(cfgvh.Upstream) {
+		return nil, fmt.Errorf("VirtualHost.UpstreamWeights must have one weight per Upstream")
+	}
+	for _, weight := range cfgvh.UpstreamWeights {
+		if weight < 1 {
+			return nil, fmt.Errorf("VirtualHost.UpstreamWeights must be at least 1")
+		}
+	}
+	be.Balance = balance
+	be.Weights = cfgvh.UpstreamWeights
+
+	if cfgvh.UpstreamMaxConns < 0 || cfgvh.UpstreamMaxIdle < 0 || cfgvh.UpstreamIdleTimeout < 0 {
+		return nil, fmt.Errorf("VirtualHost.UpstreamMaxConns, UpstreamMaxIdle and UpstreamIdleTimeout must not be negative")
+	}
+	if cfgvh.UpstreamMaxConns > 0 && cfgvh.UpstreamMaxIdle > cfgvh.UpstreamMaxConns {
+		return nil, fmt.Errorf("VirtualHost.UpstreamMaxIdle must not exceed UpstreamMaxConns")
+	}
+	be.MaxConnsPerHost = cfgvh.UpstreamMaxConns
+	be.MaxIdlePerHost = cfgvh.UpstreamMaxIdle
+	be.IdleTimeout = cfgvh.UpstreamIdleTimeout
+	return be, nil
+}
@@ -0,0 +1,149 @@
+/*
+	smtp-dkim-signer - SMTP-proxy that DKIM-signs e-mails before submission.
+	Copyright (C) 2018 - 2020, Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	dkim "github.com/emersion/go-msgauth/dkim"
+	"github.com/mback2k/smtp-dkim-signer/internal/dkimutil"
+)
+
+func printResult(idx int, m *dkimutil.Message, verif *dkim.Verification, res *dkimutil.Result, verbose bool) {
+	fmt.Printf("DKIM-Signature #%d: d=%s s=%s a=%s-%s c=%s/%s\n", idx,
+		res.Domain, res.Selector, res.KeyAlgo, res.HashAlgo, res.HeaderCan, res.BodyCan)
+
+	switch {
+	case verif == nil:
+		fmt.Printf("  result:      not verified\n")
+	case verif.Err != nil:
+		fmt.Printf("  result:      fail (%s)\n", verif.Err)
+	default:
+		fmt.Printf("  result:      pass\n")
+	}
+	if res.Err != nil {
+		fmt.Printf("  error:       %s\n", res.Err)
+	}
+	if res.ComputedBodyHash == nil {
+		return
+	}
+
+	bodyLength := "whole body"
+	if res.BodyLength >= 0 {
+		bodyLength = fmt.Sprintf("first %d bytes (l=)", res.BodyLength)
+	}
+	fmt.Printf("  body:        %d canonical bytes, hashing %s\n", res.CanonicalBodyLength, bodyLength)
+	computed := base64.StdEncoding.EncodeToString(res.ComputedBodyHash)
+	if res.BodyHashErr != nil {
+		fmt.Printf("  body hash:   MISMATCH (%s)\n", res.BodyHashErr)
+		fmt.Printf("    expected:  %s\n", base64.StdEncoding.EncodeToString(res.BodyHash))
+		fmt.Printf("    computed:  %s\n", computed)
+	} else {
+		fmt.Printf("  body hash:   match (%s)\n", computed)
+	}
+
+	var signed, absent []string
+	picker := dkimutil.NewPicker(m.Header)
+	for _, key := range res.HeaderKeys {
+		if picker.Pick(key) != "" {
+			signed = append(signed, key)
+		} else {
+			absent = append(absent, key)
+		}
+	}
+	fmt.Printf("  headers:     %s\n", strings.Join(signed, ", "))
+	if len(absent) > 0 {
+		fmt.Printf("  not present: %s\n", strings.Join(absent, ", "))
+	}
+	fmt.Printf("  header hash: %s\n", base64.StdEncoding.EncodeToString(res.HeaderHash))
+	switch {
+	case res.Key == nil:
+		fmt.Printf("  signature:   not checked\n")
+	case res.SignatureErr != nil && res.BodyHashErr == nil:
+		fmt.Printf("  signature:   MISMATCH (%s), signed header fields were modified\n", res.SignatureErr)
+	case res.SignatureErr != nil:
+		fmt.Printf("  signature:   MISMATCH (%s)\n", res.SignatureErr)
+	default:
+		fmt.Printf("  signature:   match\n")
+	}
+
+	if verbose {
+		fmt.Printf("  canonicalized header data:\n")
+		for _, line := range strings.SplitAfter(string(res.HeaderHashInput), "\r\n") {
+			fmt.Printf("    %q\n", line)
+		}
+	}
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	resolver := fs.String("resolver", "", "DNS resolver address (default system resolver)")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout for each DNS lookup")
+	verbose := fs.Bool("verbose", false, "print the canonicalized header data")
+	fs.Parse(args)
+
+	msg, err := readMessage(os.Stdin)
+	if err != nil {
+		return err
+	}
+	m, err := dkimutil.ParseMessage(msg)
+	if err != nil {
+		return err
+	}
+	fields := m.Header.SignatureFields(dkimutil.SignatureFieldName)
+	if len(fields) == 0 {
+		return fmt.Errorf("no DKIM-Signature header field found")
+	}
+
+	res := makeResolver(*resolver)
+	lookupTXT := func(domain string) ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		return res.LookupTXT(ctx, domain)
+	}
+
+	verifs, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for idx, field := range fields {
+		var verif *dkim.Verification
+		if idx < len(verifs) {
+			verif = verifs[idx]
+		}
+		if verif == nil || verif.Err != nil {
+			failed++
+		}
+		printResult(idx, m, verif, dkimutil.Verify(m, field, lookupTXT), *verbose)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d DKIM signature(s) did not verify", failed, len(fields))
+	}
+	return nil
+}